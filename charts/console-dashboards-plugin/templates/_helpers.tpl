@@ -72,9 +72,23 @@ Create the name of the configmap reader
 {{- printf "%s-configmap-reader" (include "openshift-console-plugin.name" .) }}
 {{- end }}
 
+{{/*
+Create the name of the reader of the Secrets referenced by datasources
+*/}}
+{{- define "openshift-console-plugin.secretReaderName" -}}
+{{- printf "%s-secret-reader" (include "openshift-console-plugin.name" .) }}
+{{- end }}
+
 {{/*
 Create the name secret containing the certificate
 */}}
 {{- define "openshift-console-plugin.certificateSecret" -}}
 {{ default (printf "%s-cert" (include "openshift-console-plugin.name" .)) .Values.plugin.certificateSecretName }}
 {{- end }}
+
+{{/*
+Create the name of the ConfigMap OpenShift injects the trusted CA bundle into
+*/}}
+{{- define "openshift-console-plugin.trustedCABundle" -}}
+{{- printf "%s-trusted-ca-bundle" (include "openshift-console-plugin.name" .) }}
+{{- end }}
@@ -8,20 +8,42 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sapiflag "k8s.io/component-base/cli/flag"
 
+	datasources "github.com/openshift/console-dashboards-plugin/pkg/datasources"
+	proxy "github.com/openshift/console-dashboards-plugin/pkg/proxy"
 	server "github.com/openshift/console-dashboards-plugin/pkg/server"
 )
 
 var (
-	portArg                = flag.Int("port", 0, "server port to listen on (default: 9004)")
-	certArg                = flag.String("cert", "", "cert file path to enable TLS (disabled by default)")
-	keyArg                 = flag.String("key", "", "private key file path to enable TLS (disabled by default)")
-	staticPathArg          = flag.String("static-path", "", "static files path to serve frontend (default: './web/dist')")
-	dashboardsNamespaceArg = flag.String("dashboards-namespace", "", "namespace to watch for custom datasources for dashboards (default: 'openshift-config-managed')")
-	logLevelArg            = flag.String("log-level", "error", "verbosity of logs\noptions: ['panic', 'fatal', 'error', 'warn', 'info', 'debug', 'trace']\n'trace' level will log all incoming requests\n(default 'error')")
-	tlsMinVersionArg       = flag.String("tls-min-version", "", "minimum TLS version supported. Values are from tls package constants (default: VersionTLS12)")
-	tlsCipherSuitesArg     = flag.String("tls-cipher-suites", "", "comma-separated list of cipher suites for the server")
+	portArg                 = flag.Int("port", 0, "server port to listen on (default: 9004)")
+	certArg                 = flag.String("cert", "", "cert file path to enable TLS (disabled by default)")
+	keyArg                  = flag.String("key", "", "private key file path to enable TLS (disabled by default)")
+	staticPathArg           = flag.String("static-path", "", "static files path to serve frontend (default: './web/dist')")
+	dashboardsNamespaceArg  = flag.String("dashboards-namespace", "", "comma-separated list of namespaces to watch for custom datasources for dashboards, '*' watches all namespaces (default: 'openshift-config-managed')")
+	dashboardsNsSelectorArg = flag.String("dashboards-namespace-selector", "", "label selector of additional namespaces to watch for custom datasources for dashboards")
+	datasourceAuthzArg      = flag.String("datasource-authorization", "", "permission users need to use a datasource\noptions: ['none', 'configmaps', 'datasources']\n'configmaps' requires get on the datasource ConfigMap, 'datasources' requires get on datasources.console.openshift.io in the datasource namespace\n(default 'none')")
+	datasourcesDirArg       = flag.String("datasources-dir", "", "directory of datasource YAML files to load besides the ones found in the cluster, watched for changes")
+	kubeconfigArg           = flag.String("kubeconfig", "", "kubeconfig file used when not running in a cluster (default: $KUBECONFIG or ~/.kube/config)")
+	kubeContextArg          = flag.String("kube-context", "", "kubeconfig context to use (default: the current context)")
+	disallowInsecureArg     = flag.Bool("disallow-insecure-skip-verify", false, "refuse to proxy datasources setting insecureSkipVerify, which disables TLS certificate verification")
+	trustedCABundleArg      = flag.String("trusted-ca-bundle-file", "", "PEM file of CAs trusted for every datasource besides their own CA, e.g. the OpenShift injected trusted CA bundle, re-read when it changes")
+	saTokenFileArg          = flag.String("service-account-token-file", "", "token file sent to datasources using the 'service-account' auth mode, re-read when it changes (default: '"+proxy.DefaultServiceAccountTokenFile+"')")
+	saAuthArg               = flag.Bool("service-account-auth", false, "allow the 'service-account' auth mode, which sends the token of the backend, to the datasources of '"+datasources.DefaultNamespace+"' and of -service-account-namespaces")
+	saNamespacesArg         = flag.String("service-account-namespaces", "", "comma-separated list of namespaces whose datasources may use the 'service-account' auth mode besides '"+datasources.DefaultNamespace+"'")
+	forwardTokenNsArg       = flag.String("forward-user-token-namespaces", "", "comma-separated list of namespaces whose datasources may use the 'forward-user-token' auth mode, which sends the token of the console user, besides '"+datasources.DefaultNamespace+"'")
+	forwardTokenUpstreamArg = flag.String("forward-user-token-upstreams", "", "comma-separated list of upstreams, as host or host:port, the datasources of any namespace may send the token of the console user to with the 'forward-user-token' auth mode")
+	requireNsLabelArg       = flag.Bool("require-namespace-label", false, "refuse the datasources outside '"+datasources.DefaultNamespace+"' and -namespace-label-exempt-namespaces that do not restrict their queries to their namespace with namespaceLabel")
+	nsLabelUpstreamsArg     = flag.String("namespace-label-upstreams", "", "comma-separated list of shared upstreams, as host or host:port, the datasources outside '"+datasources.DefaultNamespace+"' and -namespace-label-exempt-namespaces may only target with namespaceLabel, e.g. 'thanos-querier.openshift-monitoring.svc:9091'")
+	nsLabelExemptArg        = flag.String("namespace-label-exempt-namespaces", "", "comma-separated list of namespaces whose datasources are exempt from -require-namespace-label and -namespace-label-upstreams besides '"+datasources.DefaultNamespace+"'")
+	allowedSchemesArg       = flag.String("datasource-allowed-schemes", "", "comma-separated list of URL schemes datasources may use, out of 'http' and 'https' (default: both)")
+	allowedHostSuffixesArg  = flag.String("datasource-allowed-host-suffixes", "", "comma-separated list of host name suffixes datasource URLs may target, e.g. '.svc,.svc.cluster.local' (default: any host)")
+	allowedCIDRsArg         = flag.String("datasource-allowed-cidrs", "", "comma-separated list of IP ranges datasources may connect to, checked after DNS resolution (default: any address)")
+	deniedCIDRsArg          = flag.String("datasource-denied-cidrs", "", "comma-separated list of IP ranges datasources may never connect to, e.g. '169.254.0.0/16' for the cloud metadata endpoint")
+	logLevelArg             = flag.String("log-level", "error", "verbosity of logs\noptions: ['panic', 'fatal', 'error', 'warn', 'info', 'debug', 'trace']\n'trace' level will log all incoming requests\n(default 'error')")
+	tlsMinVersionArg        = flag.String("tls-min-version", "", "minimum TLS version supported. Values are from tls package constants (default: VersionTLS12)")
+	tlsCipherSuitesArg      = flag.String("tls-cipher-suites", "", "comma-separated list of cipher suites for the server")
 )
 
 func main() {
@@ -32,7 +54,26 @@ func main() {
 	key := mergeEnvValue("PRIVATE_KEY_FILE_PATH", *keyArg, "")
 	staticPath := mergeEnvValue("CONSOLE_DASHBOARDS_PLUGIN_STATIC_PATH", *staticPathArg, "./web/dist")
 	logLevel := mergeEnvValue("CONSOLE_DASHBOARDS_PLUGIN_LOG_LEVEL", *logLevelArg, "error")
-	dashboardsNamespace := mergeEnvValue("DASHBOARDS_NAMESPACE", *dashboardsNamespaceArg, "openshift-config-managed")
+	dashboardsNamespace := mergeEnvValue("DASHBOARDS_NAMESPACE", *dashboardsNamespaceArg, datasources.DefaultNamespace)
+	dashboardsNamespaceSelector := mergeEnvValue("DASHBOARDS_NAMESPACE_SELECTOR", *dashboardsNsSelectorArg, "")
+	datasourceAuthorization := mergeEnvValue("DATASOURCE_AUTHORIZATION", *datasourceAuthzArg, "none")
+	datasourcesDir := mergeEnvValue("DATASOURCES_DIR", *datasourcesDirArg, "")
+	kubeContext := mergeEnvValue("KUBE_CONTEXT", *kubeContextArg, "")
+	disallowInsecureSkipVerify := mergeEnvValueBool("DISALLOW_INSECURE_SKIP_VERIFY", *disallowInsecureArg)
+	trustedCABundleFile := mergeEnvValue("TRUSTED_CA_BUNDLE_FILE", *trustedCABundleArg, "")
+	serviceAccountTokenFile := mergeEnvValue("SERVICE_ACCOUNT_TOKEN_FILE", *saTokenFileArg, proxy.DefaultServiceAccountTokenFile)
+	serviceAccountAuth := mergeEnvValueBool("SERVICE_ACCOUNT_AUTH", *saAuthArg)
+	serviceAccountNamespaces := mergeEnvValue("SERVICE_ACCOUNT_NAMESPACES", *saNamespacesArg, "")
+	forwardUserTokenNamespaces := mergeEnvValue("FORWARD_USER_TOKEN_NAMESPACES", *forwardTokenNsArg, "")
+	forwardUserTokenUpstreams := mergeEnvValue("FORWARD_USER_TOKEN_UPSTREAMS", *forwardTokenUpstreamArg, "")
+	requireNamespaceLabel := mergeEnvValueBool("REQUIRE_NAMESPACE_LABEL", *requireNsLabelArg)
+	namespaceLabelUpstreams := mergeEnvValue("NAMESPACE_LABEL_UPSTREAMS", *nsLabelUpstreamsArg, "")
+	namespaceLabelExemptNamespaces := mergeEnvValue("NAMESPACE_LABEL_EXEMPT_NAMESPACES", *nsLabelExemptArg, "")
+
+	allowedSchemes := mergeEnvValue("DATASOURCE_ALLOWED_SCHEMES", *allowedSchemesArg, "")
+	allowedHostSuffixes := mergeEnvValue("DATASOURCE_ALLOWED_HOST_SUFFIXES", *allowedHostSuffixesArg, "")
+	allowedCIDRs := mergeEnvValue("DATASOURCE_ALLOWED_CIDRS", *allowedCIDRsArg, "")
+	deniedCIDRs := mergeEnvValue("DATASOURCE_DENIED_CIDRS", *deniedCIDRsArg, "")
 
 	tlsMinVersion := mergeEnvValue("TLS_MIN_VERSION", *tlsMinVersionArg, "VersionTLS12")
 	tlsCipherSuites := mergeEnvValue("TLS_CIPHER_SUITES", *tlsCipherSuitesArg, "")
@@ -51,15 +92,36 @@ func main() {
 		}
 	}
 
+	urlPolicy, err := datasources.NewURLPolicy(splitList(allowedSchemes), splitList(allowedHostSuffixes), splitList(allowedCIDRs), splitList(deniedCIDRs))
+	if err != nil {
+		logrus.Fatalf("Invalid datasource URL policy: %v", err)
+	}
+
 	srv, err := server.CreateServer(context.Background(), &server.Config{
-		Port:                port,
-		CertFile:            cert,
-		PrivateKeyFile:      key,
-		StaticPath:          staticPath,
-		LogLevel:            logLevel,
-		DashboardsNamespace: dashboardsNamespace,
-		TLSMinVersion:       tlsMinVer,
-		TLSCipherSuites:     tlsCiphers,
+		Port:                           port,
+		CertFile:                       cert,
+		PrivateKeyFile:                 key,
+		StaticPath:                     staticPath,
+		LogLevel:                       logLevel,
+		DashboardsNamespaces:           splitNamespaces(dashboardsNamespace),
+		DashboardsNamespaceSelector:    dashboardsNamespaceSelector,
+		DatasourceAuthorization:        datasourceAuthorization,
+		DatasourcesDir:                 datasourcesDir,
+		Kubeconfig:                     *kubeconfigArg,
+		KubeContext:                    kubeContext,
+		ServiceAccountTokenFile:        serviceAccountTokenFile,
+		DisallowInsecureSkipVerify:     disallowInsecureSkipVerify,
+		TrustedCABundleFile:            trustedCABundleFile,
+		URLPolicy:                      urlPolicy,
+		ServiceAccountAuth:             serviceAccountAuth,
+		ServiceAccountNamespaces:       splitList(serviceAccountNamespaces),
+		ForwardUserTokenNamespaces:     splitList(forwardUserTokenNamespaces),
+		ForwardUserTokenUpstreams:      splitList(forwardUserTokenUpstreams),
+		RequireNamespaceLabel:          requireNamespaceLabel,
+		NamespaceLabelUpstreams:        splitList(namespaceLabelUpstreams),
+		NamespaceLabelExemptNamespaces: splitList(namespaceLabelExemptNamespaces),
+		TLSMinVersion:                  tlsMinVer,
+		TLSCipherSuites:                tlsCiphers,
 	})
 	if err != nil {
 		logrus.Fatalf("Failed to create server: %v", err)
@@ -98,3 +160,41 @@ func mergeEnvValueInt(key string, arg int, defaultValue int) int {
 
 	return defaultValue
 }
+
+// mergeEnvValueBool returns true when either the flag or the environment
+// variable is set to true.
+func mergeEnvValueBool(key string, arg bool) bool {
+	if arg {
+		return true
+	}
+
+	envValue, err := strconv.ParseBool(os.Getenv(key))
+	return err == nil && envValue
+}
+
+// splitNamespaces parses a comma-separated list of namespaces, '*' stands for
+// all namespaces.
+func splitNamespaces(value string) []string {
+	namespaces := []string{}
+	for _, namespace := range strings.Split(strings.ReplaceAll(value, " ", ""), ",") {
+		switch namespace {
+		case "":
+		case "*":
+			namespaces = append(namespaces, metav1.NamespaceAll)
+		default:
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// splitList parses a comma-separated list, ignoring spaces and empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(strings.ReplaceAll(value, " ", ""), ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -13,6 +13,28 @@ import (
 
 var log = logrus.WithField("module", "datasources-api")
 
+// defaultAPIVersion is the schema datasources are served in when the request
+// does not ask for one, the schema clients were written against before
+// datasources were versioned.
+const defaultAPIVersion = datasources.APIVersionV1Alpha1
+
+// datasourceResponse is the datasource definition as served to the frontend,
+// in the requested schema, with the status of the object it was loaded from.
+func datasourceResponse(datasource interface{}, status *datasources.DatasourceStatus) ([]byte, error) {
+	data, err := json.Marshal(datasource)
+	if err != nil {
+		return nil, err
+	}
+	response := map[string]interface{}{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
+	}
+	if status != nil {
+		response["status"] = status
+	}
+	return json.Marshal(response)
+}
+
 func CreateDashboardsHandler(datasourceManager *datasources.DatasourceManager) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -31,6 +53,17 @@ func CreateDashboardsHandler(datasourceManager *datasources.DatasourceManager) f
 			return
 		}
 
+		// Requests under /api/v1/namespaces/{namespace}/ address the
+		// datasource of that namespace rather than resolving the bare name.
+		if namespace, ok := vars["namespace"]; ok {
+			if !validator.IsDNSName(namespace) {
+				log.Error("invalid datasource namespace")
+				http.Error(w, "invalid datasource namespace", http.StatusBadRequest)
+				return
+			}
+			datasourceName = datasources.DatasourceKey(namespace, datasourceName)
+		}
+
 		datasource := datasourceManager.GetDatasource(datasourceName)
 
 		if datasource == nil {
@@ -39,7 +72,18 @@ func CreateDashboardsHandler(datasourceManager *datasources.DatasourceManager) f
 			return
 		}
 
-		datasourceData, err := json.Marshal(datasource)
+		apiVersion := r.URL.Query().Get("apiVersion")
+		if apiVersion == "" {
+			apiVersion = defaultAPIVersion
+		}
+		versioned, err := datasources.ConvertDatasource(datasource, apiVersion)
+		if err != nil {
+			log.WithError(err).Errorf("cannot convert datasource: %s", datasourceName)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		datasourceData, err := datasourceResponse(versioned, datasourceManager.GetStatus(datasourceName))
 		if err != nil {
 			log.WithError(err).Error("cannot marshal datasource info")
 			http.Error(w, "cannot marshal datasource info", http.StatusInternalServerError)
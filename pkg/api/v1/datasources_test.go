@@ -1,11 +1,13 @@
 package v1
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
 
 	datasources "github.com/openshift/console-dashboards-plugin/pkg/datasources"
 )
@@ -99,3 +101,92 @@ func TestCreateDashboardsHandlerInvalidLongName(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
 	}
 }
+
+func TestCreateDashboardsHandlerNamespaced(t *testing.T) {
+	datasourceManager := datasources.NewDatasourceManager()
+
+	datasourceManager.SetDatasource(datasources.DatasourceKey("test-namespace", "test-datasource"), &datasources.DataSource{
+		Kind: "Datasource",
+		Metadata: datasources.DatasourceMetadata{
+			Name:      "test-datasource",
+			Namespace: "test-namespace",
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/namespaces/{namespace}/datasources/{name}", CreateDashboardsHandler(datasourceManager))
+
+	for path, want := range map[string]int{
+		"/api/v1/namespaces/test-namespace/datasources/test-datasource":  http.StatusOK,
+		"/api/v1/namespaces/other-namespace/datasources/test-datasource": http.StatusNotFound,
+		"/api/v1/namespaces/invalid%5c/datasources/test-datasource":      http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqRecorder := httptest.NewRecorder()
+		r.ServeHTTP(reqRecorder, req)
+
+		if status := reqRecorder.Code; status != want {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", path, status, want)
+		}
+	}
+}
+
+func TestCreateDashboardsHandlerAPIVersion(t *testing.T) {
+	datasourceManager := datasources.NewDatasourceManager()
+
+	datasourceManager.SetDatasource("test-datasource", &datasources.DataSource{
+		APIVersion: datasources.APIVersionLatest,
+		Kind:       "Datasource",
+		Metadata: datasources.DatasourceMetadata{
+			Name:      "test-datasource",
+			Namespace: "test-namespace",
+		},
+		Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+			Kind: "prometheus",
+			Spec: datasources.DatasourcePluginSpec{DirectURL: "https://prometheus:9091"},
+		}},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/datasources/{name}", CreateDashboardsHandler(datasourceManager))
+
+	tests := []struct {
+		query      string
+		status     int
+		apiVersion string
+		urlField   string
+	}{
+		{query: "", status: http.StatusOK, apiVersion: datasources.APIVersionV1Alpha1, urlField: "direct_url"},
+		{query: "?apiVersion=v1alpha1", status: http.StatusOK, apiVersion: datasources.APIVersionV1Alpha1, urlField: "direct_url"},
+		{query: "?apiVersion=console.openshift.io/v1beta1", status: http.StatusOK, apiVersion: datasources.APIVersionV1Beta1, urlField: "directURL"},
+		{query: "?apiVersion=v2", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			reqRecorder := httptest.NewRecorder()
+			r.ServeHTTP(reqRecorder, httptest.NewRequest("GET", "/api/v1/datasources/test-datasource"+tt.query, nil))
+
+			require.Equal(t, tt.status, reqRecorder.Code)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				APIVersion string `json:"apiVersion"`
+				Spec       struct {
+					Plugin struct {
+						Spec map[string]string `json:"spec"`
+					} `json:"plugin"`
+				} `json:"spec"`
+			}
+			require.NoError(t, json.Unmarshal(reqRecorder.Body.Bytes(), &response))
+			require.Equal(t, tt.apiVersion, response.APIVersion)
+			require.Equal(t, "https://prometheus:9091", response.Spec.Plugin.Spec[tt.urlField])
+		})
+	}
+}
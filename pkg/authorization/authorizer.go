@@ -0,0 +1,237 @@
+package authorization
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	validator "github.com/asaskevich/govalidator"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+var log = logrus.WithField("module", "authorization")
+
+// Mode selects which permission a user needs to use a datasource.
+type Mode string
+
+const (
+	// ModeNone lets every request through, as before access checks existed.
+	ModeNone Mode = "none"
+	// ModeConfigMaps requires "get" on the ConfigMap the datasource was
+	// loaded from. Datasources loaded from anything else, Datasource
+	// resources or files, require the same as ModeDatasources.
+	ModeConfigMaps Mode = "configmaps"
+	// ModeDatasources requires "get" on the virtual
+	// datasources.console.openshift.io resource named after the datasource
+	// in its namespace.
+	ModeDatasources Mode = "datasources"
+
+	datasourcesGroup    = "console.openshift.io"
+	datasourcesResource = "datasources"
+
+	// cacheTTL is how long allowed and denied decisions are reused.
+	cacheTTL = 10 * time.Second
+	// cacheSweepSize is the number of cached decisions above which expired
+	// ones are dropped.
+	cacheSweepSize = 1024
+)
+
+func ParseMode(value string) (Mode, error) {
+	switch Mode(value) {
+	case "", ModeNone:
+		return ModeNone, nil
+	case ModeConfigMaps, ModeDatasources:
+		return Mode(value), nil
+	default:
+		return "", fmt.Errorf("unknown datasource authorization mode %q: must be one of %q, %q or %q", value, ModeNone, ModeConfigMaps, ModeDatasources)
+	}
+}
+
+// reviewFunc asks the API server whether the user owning the token is
+// allowed the attributes.
+type reviewFunc func(ctx context.Context, token string, attributes *authorizationv1.ResourceAttributes) (bool, error)
+
+type decision struct {
+	allowed bool
+	expires time.Time
+}
+
+// Authorizer checks with a SelfSubjectAccessReview, sent with the console
+// user's own bearer token, whether the user may use a datasource. Decisions
+// are cached for a short time so that dashboards issuing many queries do not
+// cost a review each.
+type Authorizer struct {
+	mode   Mode
+	review reviewFunc
+	now    func() time.Time
+	cache  map[string]decision
+	mutex  sync.Mutex
+}
+
+// NewAuthorizer creates an authorizer reviewing access against the API
+// server described by config. Only the host and TLS settings of config are
+// used, reviews are always authenticated as the user.
+func NewAuthorizer(config *rest.Config, mode Mode) *Authorizer {
+	anonymousConfig := rest.AnonymousClientConfig(config)
+
+	return newAuthorizer(mode, func(ctx context.Context, token string, attributes *authorizationv1.ResourceAttributes) (bool, error) {
+		userConfig := rest.CopyConfig(anonymousConfig)
+		userConfig.BearerToken = token
+
+		client, err := kubernetes.NewForConfig(userConfig)
+		if err != nil {
+			return false, err
+		}
+
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return false, err
+		}
+		return review.Status.Allowed, nil
+	})
+}
+
+func newAuthorizer(mode Mode, review reviewFunc) *Authorizer {
+	return &Authorizer{
+		mode:   mode,
+		review: review,
+		now:    time.Now,
+		cache:  map[string]decision{},
+	}
+}
+
+func (a *Authorizer) attributes(datasource *datasources.DataSource, source *datasources.DatasourceSource) *authorizationv1.ResourceAttributes {
+	if a.mode == ModeConfigMaps && (source == nil || source.Kind == datasources.SourceKindConfigMap) {
+		attributes := &authorizationv1.ResourceAttributes{
+			Namespace: datasource.Metadata.Namespace,
+			Verb:      "get",
+			Resource:  "configmaps",
+		}
+		if source != nil {
+			attributes.Namespace = source.Namespace
+			attributes.Name = source.Name
+		}
+		return attributes
+	}
+
+	return &authorizationv1.ResourceAttributes{
+		Namespace: datasource.Metadata.Namespace,
+		Verb:      "get",
+		Group:     datasourcesGroup,
+		Resource:  datasourcesResource,
+		Name:      datasource.Metadata.Name,
+	}
+}
+
+// Allowed reports whether the user owning the token may use the datasource.
+func (a *Authorizer) Allowed(ctx context.Context, token string, datasource *datasources.DataSource, source *datasources.DatasourceSource) (bool, error) {
+	attributes := a.attributes(datasource, source)
+
+	tokenHash := sha256.Sum256([]byte(token))
+	key := strings.Join([]string{hex.EncodeToString(tokenHash[:]), attributes.Namespace, attributes.Resource, attributes.Name}, "/")
+
+	a.mutex.Lock()
+	cached, ok := a.cache[key]
+	a.mutex.Unlock()
+	if ok && a.now().Before(cached.expires) {
+		return cached.allowed, nil
+	}
+
+	allowed, err := a.review(ctx, token, attributes)
+	if err != nil {
+		return false, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := a.now()
+	if len(a.cache) >= cacheSweepSize {
+		for cachedKey, cachedDecision := range a.cache {
+			if !now.Before(cachedDecision.expires) {
+				delete(a.cache, cachedKey)
+			}
+		}
+	}
+	a.cache[key] = decision{allowed: allowed, expires: now.Add(cacheTTL)}
+
+	return allowed, nil
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// Handler wraps a datasource handler, only calling it when the user is
+// allowed to use the datasource named by the route variable nameVar, and the
+// optional "namespace" route variable. Requests for unknown datasources are
+// passed on so that the wrapped handler reports them.
+func (a *Authorizer) Handler(datasourceManager *datasources.DatasourceManager, nameVar string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil || a.mode == ModeNone {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		datasourceName := vars[nameVar]
+		if namespace, ok := vars["namespace"]; ok {
+			if !validator.IsDNSName(namespace) {
+				next(w, r)
+				return
+			}
+			datasourceName = datasources.DatasourceKey(namespace, datasourceName)
+		}
+
+		datasource := datasourceManager.GetDatasource(datasourceName)
+		if datasource == nil {
+			next(w, r)
+			return
+		}
+
+		token := bearerToken(r)
+		if token == "" {
+			log.Errorf("missing bearer token for datasource: %s", datasourceName)
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		allowed, err := a.Allowed(r.Context(), token, datasource, datasourceManager.GetSource(datasourceName))
+		if err != nil {
+			if apierrors.IsUnauthorized(err) {
+				log.WithError(err).Errorf("invalid bearer token for datasource: %s", datasourceName)
+				http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+				return
+			}
+			log.WithError(err).Errorf("cannot review access to datasource: %s", datasourceName)
+			http.Error(w, "cannot review access to datasource", http.StatusInternalServerError)
+			return
+		}
+
+		if !allowed {
+			log.Debugf("access denied to datasource: %s", datasourceName)
+			http.Error(w, "access to datasource denied", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,154 @@
+package authorization
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+type fakeReviewer struct {
+	allowedTokens map[string]bool
+	err           error
+	reviews       []*authorizationv1.ResourceAttributes
+}
+
+func (f *fakeReviewer) review(ctx context.Context, token string, attributes *authorizationv1.ResourceAttributes) (bool, error) {
+	f.reviews = append(f.reviews, attributes)
+	if f.err != nil {
+		return false, f.err
+	}
+	return f.allowedTokens[token], nil
+}
+
+func newTestManager() *datasources.DatasourceManager {
+	manager := datasources.NewDatasourceManager()
+	manager.SetDatasource("test-datasource", &datasources.DataSource{
+		Kind: "Datasource",
+		Metadata: datasources.DatasourceMetadata{
+			Name:      "test-datasource",
+			Namespace: "test-namespace",
+		},
+	})
+	return manager
+}
+
+func serve(t *testing.T, authorizer *Authorizer, manager *datasources.DatasourceManager, path string, token string) int {
+	t.Helper()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/datasources/{name}", authorizer.Handler(manager, "name", func(w http.ResponseWriter, r *http.Request) {
+		if manager.GetDatasource(mux.Vars(r)["name"]) == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	req, err := http.NewRequest("GET", path, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestParseMode(t *testing.T) {
+	for value, want := range map[string]Mode{
+		"":            ModeNone,
+		"none":        ModeNone,
+		"configmaps":  ModeConfigMaps,
+		"datasources": ModeDatasources,
+	} {
+		mode, err := ParseMode(value)
+		require.NoError(t, err)
+		require.Equal(t, want, mode)
+	}
+
+	_, err := ParseMode("everyone")
+	require.Error(t, err)
+}
+
+func TestHandler(t *testing.T) {
+	reviewer := &fakeReviewer{allowedTokens: map[string]bool{"allowed": true}}
+	authorizer := newAuthorizer(ModeDatasources, reviewer.review)
+	manager := newTestManager()
+
+	require.Equal(t, http.StatusOK, serve(t, authorizer, manager, "/api/v1/datasources/test-datasource", "allowed"))
+	require.Equal(t, http.StatusForbidden, serve(t, authorizer, manager, "/api/v1/datasources/test-datasource", "denied"))
+	require.Equal(t, http.StatusUnauthorized, serve(t, authorizer, manager, "/api/v1/datasources/test-datasource", ""))
+	require.Equal(t, http.StatusNotFound, serve(t, authorizer, manager, "/api/v1/datasources/unknown", "denied"))
+
+	require.Equal(t, &authorizationv1.ResourceAttributes{
+		Namespace: "test-namespace",
+		Verb:      "get",
+		Group:     "console.openshift.io",
+		Resource:  "datasources",
+		Name:      "test-datasource",
+	}, reviewer.reviews[0])
+}
+
+func TestHandlerReviewErrors(t *testing.T) {
+	manager := newTestManager()
+
+	unauthorized := &fakeReviewer{err: apierrors.NewUnauthorized("invalid token")}
+	require.Equal(t, http.StatusUnauthorized, serve(t, newAuthorizer(ModeConfigMaps, unauthorized.review), manager, "/api/v1/datasources/test-datasource", "token"))
+
+	failing := &fakeReviewer{err: errors.New("connection refused")}
+	require.Equal(t, http.StatusInternalServerError, serve(t, newAuthorizer(ModeConfigMaps, failing.review), manager, "/api/v1/datasources/test-datasource", "token"))
+
+	forbidden := &fakeReviewer{err: apierrors.NewForbidden(schema.GroupResource{}, "", errors.New("forbidden"))}
+	require.Equal(t, http.StatusInternalServerError, serve(t, newAuthorizer(ModeConfigMaps, forbidden.review), manager, "/api/v1/datasources/test-datasource", "token"))
+}
+
+func TestHandlerModeNone(t *testing.T) {
+	reviewer := &fakeReviewer{}
+	manager := newTestManager()
+
+	require.Equal(t, http.StatusOK, serve(t, newAuthorizer(ModeNone, reviewer.review), manager, "/api/v1/datasources/test-datasource", ""))
+	require.Equal(t, http.StatusOK, serve(t, nil, manager, "/api/v1/datasources/test-datasource", ""))
+	require.Empty(t, reviewer.reviews)
+}
+
+func TestAllowedCachesDecisions(t *testing.T) {
+	reviewer := &fakeReviewer{allowedTokens: map[string]bool{"allowed": true}}
+	authorizer := newAuthorizer(ModeConfigMaps, reviewer.review)
+	now := time.Now()
+	authorizer.now = func() time.Time { return now }
+
+	datasource := &datasources.DataSource{Metadata: datasources.DatasourceMetadata{Name: "test-datasource", Namespace: "test-namespace"}}
+	source := &datasources.DatasourceSource{Kind: datasources.SourceKindConfigMap, Namespace: "test-namespace", Name: "test-configmap"}
+
+	for i := 0; i < 3; i++ {
+		allowed, err := authorizer.Allowed(context.Background(), "allowed", datasource, source)
+		require.NoError(t, err)
+		require.True(t, allowed)
+
+		allowed, err = authorizer.Allowed(context.Background(), "denied", datasource, source)
+		require.NoError(t, err)
+		require.False(t, allowed)
+	}
+	require.Len(t, reviewer.reviews, 2)
+	require.Equal(t, &authorizationv1.ResourceAttributes{
+		Namespace: "test-namespace",
+		Verb:      "get",
+		Resource:  "configmaps",
+		Name:      "test-configmap",
+	}, reviewer.reviews[0])
+
+	now = now.Add(cacheTTL)
+	_, err := authorizer.Allowed(context.Background(), "allowed", datasource, source)
+	require.NoError(t, err)
+	require.Len(t, reviewer.reviews, 3)
+}
@@ -0,0 +1,161 @@
+package datasources
+
+import (
+	"encoding/json"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// The status annotations tell the owners of a datasource ConfigMap
+	// whether it could be loaded and reached.
+	statusAnnotation        = "console.openshift.io/dashboard-datasource-status"
+	statusMessageAnnotation = "console.openshift.io/dashboard-datasource-status-message"
+	statusTimeAnnotation    = "console.openshift.io/dashboard-datasource-status-time"
+
+	// eventsComponent is the source of the Kubernetes Events of the plugin.
+	eventsComponent = "console-dashboards-plugin"
+)
+
+// ReportStatus writes the status onto the ConfigMap of the source when it
+// changed, statuses of other sources are ignored. A Loaded status only
+// tells that an unreachable datasource answers again, the ConfigMap then
+// gets back the status it was loaded with.
+func (p *KubernetesProvider) ReportStatus(source DatasourceSource, status LoadStatus) {
+	if source.Kind != SourceKindConfigMap {
+		return
+	}
+
+	p.mutex.Lock()
+	_, known := p.known[source.Key()]
+	source = source.Object()
+	key := source.Key()
+	if status.Reason == LoadReasonLoaded {
+		if p.statuses[key].Reason != LoadReasonUnreachable {
+			known = false
+		}
+		status = p.loadStatuses[key]
+	}
+	p.mutex.Unlock()
+	if !known {
+		return
+	}
+
+	if p.changeStatus(source, status, nil) {
+		p.queueStatus(source, status)
+	}
+}
+
+// setConfigMapStatus writes the status of a ConfigMap that was just loaded.
+// Its annotations avoid writing the same status again after a restart.
+func (p *KubernetesProvider) setConfigMapStatus(source DatasourceSource, status LoadStatus, annotations map[string]string) {
+	p.mutex.Lock()
+	p.loadStatuses[source.Key()] = status
+	p.mutex.Unlock()
+
+	if p.changeStatus(source, status, annotations) {
+		p.queueStatus(source, status)
+	}
+}
+
+// queueStatus hands the status over to the writer of the statuses, neither
+// the proxied requests nor the informer handlers wait for the API server.
+// Only the latest status of a ConfigMap is written when several are queued.
+func (p *KubernetesProvider) queueStatus(source DatasourceSource, status LoadStatus) {
+	key := source.Key()
+	p.mutex.Lock()
+	p.pendingStatuses[key] = statusWrite{source: source, status: status}
+	p.mutex.Unlock()
+	p.statusQueue.Add(key)
+}
+
+// writeStatuses writes the queued statuses one at a time, in the order
+// they were queued, until the queue is shut down.
+func (p *KubernetesProvider) writeStatuses() {
+	for {
+		key, shutdown := p.statusQueue.Get()
+		if shutdown {
+			return
+		}
+		p.mutex.Lock()
+		write, ok := p.pendingStatuses[key]
+		delete(p.pendingStatuses, key)
+		p.mutex.Unlock()
+		if ok {
+			p.writeConfigMapStatus(write.source, write.status)
+		}
+		p.statusQueue.Done(key)
+	}
+}
+
+// changeStatus records the status of the source and reports whether it
+// differs from the one written last.
+func (p *KubernetesProvider) changeStatus(source DatasourceSource, status LoadStatus, annotations map[string]string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := source.Key()
+	previous, ok := p.statuses[key]
+	if !ok && annotations != nil {
+		previous = LoadStatus{Reason: annotations[statusAnnotation], Message: annotations[statusMessageAnnotation]}
+		ok = true
+	}
+	p.statuses[key] = status
+	return !ok || previous != status
+}
+
+func (p *KubernetesProvider) forgetStatus(source DatasourceSource) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.statuses, source.Key())
+	delete(p.loadStatuses, source.Key())
+	delete(p.pendingStatuses, source.Key())
+}
+
+// statusWrite is a status waiting to be written onto its ConfigMap.
+type statusWrite struct {
+	source DatasourceSource
+	status LoadStatus
+}
+
+// writeConfigMapStatus annotates the ConfigMap with the status and emits a
+// matching Event. The patch is conditional on the UID so that a ConfigMap
+// recreated under the same name is left alone.
+func (p *KubernetesProvider) writeConfigMapStatus(source DatasourceSource, status LoadStatus) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"uid": source.UID,
+			"annotations": map[string]string{
+				statusAnnotation:        status.Reason,
+				statusMessageAnnotation: status.Message,
+				statusTimeAnnotation:    time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		log.WithError(err).Errorf("cannot marshal status of %s", source.Key())
+		return
+	}
+
+	_, err = p.client.CoreV1().ConfigMaps(source.Namespace).Patch(p.ctx, source.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		log.WithError(err).Errorf("cannot write status of %s", source.Key())
+	}
+
+	eventType := v1.EventTypeNormal
+	if status.Reason != LoadReasonLoaded {
+		eventType = v1.EventTypeWarning
+	}
+	reference := &v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       SourceKindConfigMap,
+		Namespace:  source.Namespace,
+		Name:       source.Name,
+		UID:        source.UID,
+	}
+	p.recorder.Event(reference, eventType, status.Reason, status.Message)
+}
@@ -0,0 +1,178 @@
+package datasources
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func configMapStatus(t *testing.T, client *fake.Clientset, name string) string {
+	t.Helper()
+	configMap, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	return configMap.Annotations[statusAnnotation]
+}
+
+func hasEvent(t *testing.T, client *fake.Clientset, name string, reason string) bool {
+	t.Helper()
+	events, err := client.CoreV1().Events(testNamespace).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	for _, event := range events.Items {
+		if event.InvolvedObject.Name == name && event.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConfigMapStatus_Loaded(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newDatasourceConfigMap("datasource", datasourceYaml("prometheus", "https://prometheus:9091")),
+	)
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonLoaded
+	}, waitTimeout, waitInterval)
+	require.Eventually(t, func() bool {
+		return hasEvent(t, client, "datasource", LoadReasonLoaded)
+	}, waitTimeout, waitInterval)
+
+	configMap, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), "datasource", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotEmpty(t, configMap.Annotations[statusTimeAnnotation])
+}
+
+func TestConfigMapStatus_ParseError(t *testing.T) {
+	client := fake.NewSimpleClientset(newDatasourceConfigMap("datasource", "kind: ["))
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonParseError
+	}, waitTimeout, waitInterval)
+	require.Eventually(t, func() bool {
+		return hasEvent(t, client, "datasource", LoadReasonParseError)
+	}, waitTimeout, waitInterval)
+}
+
+func TestConfigMapStatus_InvalidCA(t *testing.T) {
+	configMap := newDatasourceConfigMap("datasource", datasourceYaml("prometheus", "https://prometheus:9091"))
+	configMap.Data[datasourceCAKey] = "not a certificate"
+	client := fake.NewSimpleClientset(configMap)
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonInvalidCA
+	}, waitTimeout, waitInterval)
+}
+
+func TestConfigMapStatus_Unreachable(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newDatasourceConfigMap("datasource", datasourceYaml("prometheus", "https://prometheus:9091")),
+	)
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonLoaded
+	}, waitTimeout, waitInterval)
+
+	manager.ReportStatus("prometheus", LoadStatus{Reason: LoadReasonUnreachable, Message: "connection refused"})
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonUnreachable
+	}, waitTimeout, waitInterval)
+
+	manager.ReportStatus("prometheus", LoadStatus{Reason: LoadReasonLoaded})
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonLoaded
+	}, waitTimeout, waitInterval)
+}
+
+func TestConfigMapStatus_Warnings(t *testing.T) {
+	client := fake.NewSimpleClientset(newDatasourceConfigMap("datasource",
+		datasourceYaml("prometheus", "https://prometheus:9091")+"unknown: true\n"))
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonLoaded
+	}, waitTimeout, waitInterval)
+
+	configMap, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), "datasource", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Contains(t, configMap.Annotations[statusMessageAnnotation], `unknown field "unknown"`)
+}
+
+func TestConfigMapStatus_InvalidDatasource(t *testing.T) {
+	client := fake.NewSimpleClientset(newDatasourceConfigMap("datasource", `kind: "Dashboard"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "graphite"
+    spec:
+      direct_url: "prometheus:9091"
+`))
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "datasource") == LoadReasonInvalidDatasource
+	}, waitTimeout, waitInterval)
+
+	configMap, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), "datasource", metav1.GetOptions{})
+	require.NoError(t, err)
+	message := configMap.Annotations[statusMessageAnnotation]
+	require.Contains(t, message, "kind")
+	require.Contains(t, message, "spec.plugin.kind")
+	require.Contains(t, message, "spec.plugin.spec.direct_url")
+}
+
+func TestConfigMapStatus_WrittenAsynchronously(t *testing.T) {
+	first := newDatasourceConfigMap("first", datasourceYaml("first", "https://prometheus:9091"))
+	second := newDatasourceConfigMap("second", datasourceYaml("second", "https://prometheus:9091"))
+	client := fake.NewSimpleClientset(first, second)
+	patched := make(chan string, 3)
+	release := make(chan struct{})
+	client.PrependReactor("patch", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patched <- action.(k8stesting.PatchAction).GetName()
+		<-release
+		return false, nil, nil
+	})
+
+	provider := NewKubernetesProvider(client, nil, WatchOptions{Namespaces: []string{testNamespace}})
+	provider.ctx = context.Background()
+	provider.recorder = record.NewFakeRecorder(10)
+	provider.statusQueue = workqueue.NewTyped[string]()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		provider.writeStatuses()
+	}()
+
+	// loading goes on while the API server holds the first write, and only
+	// the latest status queued for the second ConfigMap is written
+	provider.setConfigMapStatus(configMapSource(first), LoadStatus{Reason: LoadReasonLoaded}, nil)
+	require.Equal(t, "first", <-patched)
+	provider.setConfigMapStatus(configMapSource(second), LoadStatus{Reason: LoadReasonLoaded}, nil)
+	provider.setConfigMapStatus(configMapSource(second), LoadStatus{Reason: LoadReasonParseError, Message: "invalid"}, nil)
+
+	close(release)
+	require.Equal(t, "second", <-patched)
+	provider.statusQueue.ShutDownWithDrain()
+	<-written
+
+	require.Equal(t, LoadReasonLoaded, configMapStatus(t, client, "first"))
+	require.Equal(t, LoadReasonParseError, configMapStatus(t, client, "second"))
+	require.Empty(t, patched, "the status of the second ConfigMap is written once")
+}
@@ -0,0 +1,231 @@
+package datasources
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	datasourceKey   = "dashboard-datasource.yaml"
+	datasourceCAKey = "dashboard-datasource-ca"
+	// A ConfigMap can define more datasources in keys with this suffix,
+	// e.g. shard-1.datasource.yaml with its CA in shard-1.datasource-ca.
+	datasourceKeySuffix   = ".datasource.yaml"
+	datasourceCAKeySuffix = ".datasource-ca"
+)
+
+var datasourceLabelSelector = labels.SelectorFromSet(labels.Set{"console.openshift.io/dashboard-datasource": "true"})
+
+func (p *KubernetesProvider) configMapHandler(accept func(namespace string) bool) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if configMap, ok := obj.(*v1.ConfigMap); ok {
+				if accept(configMap.Namespace) {
+					p.loadConfigMap(configMap)
+				}
+			} else {
+				log.Debugf("failed when added %v", obj)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldConfigMap, ok := oldObj.(*v1.ConfigMap)
+			if !ok {
+				log.Debugf("failed when modified %v", oldObj)
+				return
+			}
+			newConfigMap, ok := newObj.(*v1.ConfigMap)
+			if !ok {
+				log.Debugf("failed when modified %v", newObj)
+				return
+			}
+			// Periodic resyncs deliver unchanged objects and the status
+			// annotations only change the metadata, reloading them would only
+			// throw away the cached proxies.
+			if oldConfigMap.ResourceVersion == newConfigMap.ResourceVersion {
+				return
+			}
+			if oldConfigMap.UID == newConfigMap.UID && reflect.DeepEqual(oldConfigMap.Data, newConfigMap.Data) {
+				return
+			}
+			if accept(newConfigMap.Namespace) {
+				p.loadConfigMap(newConfigMap)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if configMap, ok := obj.(*v1.ConfigMap); ok {
+				p.deleteObject(configMapSource(configMap))
+				p.forgetStatus(configMapSource(configMap))
+			} else {
+				log.Debugf("failed when deleted %v", obj)
+			}
+		},
+	}
+}
+
+func configMapSource(configMap *v1.ConfigMap) DatasourceSource {
+	return DatasourceSource{
+		Kind:      SourceKindConfigMap,
+		Namespace: configMap.Namespace,
+		Name:      configMap.Name,
+		UID:       configMap.UID,
+	}
+}
+
+// loadConfigMap reports the datasources defined by the ConfigMap and writes
+// the outcome back onto it.
+func (p *KubernetesProvider) loadConfigMap(configMap *v1.ConfigMap) {
+	events := configMapEvents(configMap, p.options.Policy)
+	p.updateObject(configMapSource(configMap), events)
+	p.setConfigMapStatus(configMapSource(configMap), combinedStatus(events), configMap.Annotations)
+}
+
+// configMapDatasourceKeys returns the keys of the ConfigMap defining
+// datasources, sorted so that they are always read in the same order.
+func configMapDatasourceKeys(configMap *v1.ConfigMap) []string {
+	keys := []string{}
+	for key := range configMap.Data {
+		if key == datasourceKey || strings.HasSuffix(key, datasourceKeySuffix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func datasourceCAKeyFor(key string) string {
+	if key == datasourceKey {
+		return datasourceCAKey
+	}
+	return strings.TrimSuffix(key, datasourceKeySuffix) + datasourceCAKeySuffix
+}
+
+// configMapEntry names the document of a key. The first document of the
+// original key is the datasource of single datasource ConfigMaps, it has
+// no entry name so that its source stays the same as before.
+func configMapEntry(key string, document int) string {
+	if document > 0 {
+		return fmt.Sprintf("%s#%d", key, document)
+	}
+	if key == datasourceKey {
+		return ""
+	}
+	return key
+}
+
+// splitDocuments splits a multi-document YAML value, documents with nothing
+// but comments are skipped.
+func splitDocuments(value string) ([][]byte, error) {
+	reader := yaml.NewYAMLReader(bufio.NewReader(strings.NewReader(value)))
+	documents := [][]byte{}
+	for {
+		document, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isEmptyDocument(document) {
+			continue
+		}
+		documents = append(documents, document)
+	}
+}
+
+func isEmptyDocument(document []byte) bool {
+	for _, line := range strings.Split(string(document), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "---" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// configMapEvents reads the datasources defined by the ConfigMap, one event
+// per YAML document of every datasource key. Datasources the policy does not
+// allow are invalid.
+func configMapEvents(configMap *v1.ConfigMap, policy *Policy) []DatasourceEvent {
+	source := configMapSource(configMap)
+	newEvent := func(entry string) DatasourceEvent {
+		event := DatasourceEvent{
+			Source:            source,
+			CreationTimestamp: configMap.CreationTimestamp.Time,
+		}
+		event.Source.Entry = entry
+		return event
+	}
+
+	keys := configMapDatasourceKeys(configMap)
+	if len(keys) == 0 {
+		event := newEvent("")
+		event.Err = &LoadError{Reason: LoadReasonParseError, Err: fmt.Errorf("key '%s' not found", datasourceKey)}
+		log.Errorf("key '%s' not found in configMap: %s", datasourceKey, source.Key())
+		return []DatasourceEvent{event}
+	}
+
+	events := []DatasourceEvent{}
+	for _, key := range keys {
+		documents, err := splitDocuments(configMap.Data[key])
+		if err == nil && len(documents) == 0 {
+			err = errors.New("no datasource found")
+		}
+		if err != nil {
+			event := newEvent(configMapEntry(key, 0))
+			event.Err = &LoadError{Reason: LoadReasonParseError, Err: fmt.Errorf("cannot unmarshall key '%s': %w", key, err)}
+			log.WithError(err).Errorf("cannot unmarshall configmap datasource in key '%s': %s", key, source.Key())
+			events = append(events, event)
+			continue
+		}
+
+		var ca *string
+		if caValue, ok := configMap.Data[datasourceCAKeyFor(key)]; ok {
+			ca = &caValue
+		}
+		for i, document := range documents {
+			event := newEvent(configMapEntry(key, i))
+			loadConfigMapDocument(&event, configMap.Namespace, key, document, ca, policy)
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// loadConfigMapDocument reads the datasource of one document into the event.
+func loadConfigMapDocument(event *DatasourceEvent, namespace string, key string, document []byte, ca *string, policy *Policy) {
+	configMapData, warnings, err := decodeDatasource(document)
+	if err != nil {
+		event.Err = &LoadError{Reason: LoadReasonParseError, Err: fmt.Errorf("cannot unmarshall key '%s': %w", key, err)}
+		log.WithError(err).Errorf("cannot unmarshall configmap datasource in key '%s': %s", key, event.Source.Key())
+		return
+	}
+	event.Warnings = warnings
+	for _, warning := range warnings {
+		log.Warnf("configmap datasource in key '%s': %s: %s", key, event.Source.Key(), warning)
+	}
+	// The namespace always comes from the ConfigMap, so that a datasource
+	// cannot claim to live in another namespace.
+	configMapData.Metadata.Namespace = namespace
+
+	if err := configMapData.ValidateWithPolicy(policy); err != nil {
+		event.Err = &LoadError{Reason: LoadReasonInvalidDatasource, Err: err}
+		log.WithError(err).Errorf("invalid configmap datasource in key '%s': %s", key, event.Source.Key())
+		return
+	}
+
+	event.Datasource = configMapData
+	event.CA = ca
+}
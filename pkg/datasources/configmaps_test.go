@@ -0,0 +1,99 @@
+package datasources
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapEvents_MultipleDatasources(t *testing.T) {
+	configMap := newDatasourceConfigMap("shards",
+		datasourceYaml("shard-0", "https://shard-0:9091")+"---\n# comments only\n---\n"+datasourceYaml("shard-1", "https://shard-1:9091"))
+	configMap.Data["shard-2.datasource.yaml"] = datasourceYaml("shard-2", "https://shard-2:9091")
+	configMap.Data["shard-2.datasource-ca"] = "shard-2-ca"
+	configMap.Data[datasourceCAKey] = "ca"
+	configMap.Data["notes.yaml"] = datasourceYaml("ignored", "https://ignored:9091")
+
+	events := configMapEvents(configMap, nil)
+
+	require.Len(t, events, 3)
+	entries := map[string]string{}
+	for _, event := range events {
+		require.NoError(t, event.Err)
+		entries[event.Datasource.Metadata.Name] = event.Source.Entry
+	}
+	require.Equal(t, map[string]string{
+		"shard-0": "",
+		"shard-1": "dashboard-datasource.yaml#1",
+		"shard-2": "shard-2.datasource.yaml",
+	}, entries)
+	require.Equal(t, "ca", *events[0].CA)
+	require.Equal(t, "ca", *events[1].CA)
+	require.Equal(t, "shard-2-ca", *events[2].CA)
+}
+
+func TestWatchDatasources_MultipleDatasources(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	manager := NewDatasourceManager()
+	configMaps := client.CoreV1().ConfigMaps(testNamespace)
+
+	startWatch(t, manager, client)
+
+	configMap := newDatasourceConfigMap("shards", datasourceYaml("shard-0", "https://shard-0:9091")+"---\n"+datasourceYaml("shard-1", "https://shard-1:9091"))
+	configMap.Data["shard-2.datasource.yaml"] = datasourceYaml("shard-2", "https://shard-2:9091")
+	_, err := configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("shard-0") != nil && manager.GetDatasource("shard-1") != nil && manager.GetDatasource("shard-2") != nil
+	}, waitTimeout, waitInterval)
+	require.Equal(t, "shard-2.datasource.yaml", manager.GetSource("shard-2").Entry)
+
+	// dropping a document and a key only deletes their datasources
+	configMap.ResourceVersion = "2"
+	configMap.Data[datasourceKey] = datasourceYaml("shard-0", "https://shard-0:9091")
+	delete(configMap.Data, "shard-2.datasource.yaml")
+	_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("shard-1") == nil && manager.GetDatasource("shard-2") == nil
+	}, waitTimeout, waitInterval)
+	require.NotNil(t, manager.GetDatasource("shard-0"))
+
+	configMap.ResourceVersion = "3"
+	configMap.Data["shard-2.datasource.yaml"] = datasourceYaml("shard-2", "https://shard-2:9091")
+	_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("shard-2") != nil
+	}, waitTimeout, waitInterval)
+
+	// deleting the ConfigMap deletes all of them
+	require.NoError(t, configMaps.Delete(context.Background(), "shards", metav1.DeleteOptions{}))
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("shard-0") == nil && manager.GetDatasource("shard-2") == nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestConfigMapStatus_MultipleDatasources(t *testing.T) {
+	configMap := newDatasourceConfigMap("shards", datasourceYaml("shard-0", "https://shard-0:9091"))
+	configMap.Data["shard-1.datasource.yaml"] = datasourceYaml("shard-1", "not a url")
+	client := fake.NewSimpleClientset(configMap)
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return configMapStatus(t, client, "shards") == LoadReasonInvalidDatasource
+	}, waitTimeout, waitInterval)
+	require.NotNil(t, manager.GetDatasource("shard-0"))
+
+	loaded, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), "shards", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Contains(t, loaded.Annotations[statusMessageAnnotation], "shard-1.datasource.yaml: ")
+}
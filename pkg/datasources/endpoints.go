@@ -0,0 +1,122 @@
+package datasources
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Endpoint allows the requests made with one of its methods to the paths
+// matching its pattern, in which a * segment stands for any one path
+// segment, e.g. /api/v1/label/*/values.
+type Endpoint struct {
+	Path string `json:"path"`
+	// Methods are the allowed HTTP methods, GET when empty.
+	Methods []string `json:"methods,omitempty"`
+}
+
+// pluginEndpoints are the endpoints the proxy serves for each plugin kind,
+// the read-only ones the dashboards query. Admin endpoints such as
+// /api/v1/admin/tsdb/delete_series or /-/quit are left out.
+var pluginEndpoints = map[string][]Endpoint{
+	PluginKindPrometheus: {
+		{Path: "/api/v1/query", Methods: []string{http.MethodGet, http.MethodPost}},
+		{Path: "/api/v1/query_range", Methods: []string{http.MethodGet, http.MethodPost}},
+		{Path: "/api/v1/series", Methods: []string{http.MethodGet, http.MethodPost}},
+		{Path: "/api/v1/labels", Methods: []string{http.MethodGet, http.MethodPost}},
+		{Path: "/api/v1/label/*/values", Methods: []string{http.MethodGet}},
+	},
+}
+
+// endpointMethods are the methods endpoints may allow.
+var endpointMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// AllowedEndpoints returns the endpoints the proxy serves for the
+// datasource, the ones of its plugin kind unless the datasource lists its
+// own. Datasources of unknown kinds have none.
+func (datasource *DataSource) AllowedEndpoints() []Endpoint {
+	if endpoints := datasource.Spec.Plugin.Spec.AllowedEndpoints; len(endpoints) > 0 {
+		return endpoints
+	}
+	pluginKind, ok := PluginKind(datasource.Spec.Plugin.Kind)
+	if !ok {
+		return nil
+	}
+	return pluginEndpoints[pluginKind]
+}
+
+// AllowsRequest reports whether the proxy may forward a request with the
+// method to the path of the datasource. Paths that are not clean, e.g.
+// holding .. segments, are never allowed.
+func (datasource *DataSource) AllowsRequest(method string, requestPath string) bool {
+	if requestPath == "" || path.Clean(requestPath) != requestPath {
+		return false
+	}
+	return slices.ContainsFunc(datasource.AllowedEndpoints(), func(endpoint Endpoint) bool {
+		return endpoint.allowsMethod(method) && matchesPathPattern(endpoint.Path, requestPath)
+	})
+}
+
+func (endpoint Endpoint) allowsMethod(method string) bool {
+	if len(endpoint.Methods) == 0 {
+		return method == http.MethodGet
+	}
+	return slices.Contains(endpoint.Methods, method)
+}
+
+// matchesPathPattern compares the path to the pattern segment by segment.
+func matchesPathPattern(pattern string, requestPath string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(requestPath, "/")
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment == "*" {
+			if pathSegments[i] == "" {
+				return false
+			}
+		} else if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func validateEndpoints(path *field.Path, endpoints []Endpoint) field.ErrorList {
+	errs := field.ErrorList{}
+	for i, endpoint := range endpoints {
+		endpointPath := path.Index(i)
+		errs = append(errs, validateEndpointPath(endpointPath.Child("path"), endpoint.Path)...)
+		for j, method := range endpoint.Methods {
+			if !slices.Contains(endpointMethods, method) {
+				errs = append(errs, field.NotSupported(endpointPath.Child("methods").Index(j), method, endpointMethods))
+			}
+		}
+	}
+	return errs
+}
+
+func validateEndpointPath(fieldPath *field.Path, pattern string) field.ErrorList {
+	switch {
+	case pattern == "":
+		return field.ErrorList{field.Required(fieldPath, "")}
+	case !strings.HasPrefix(pattern, "/"):
+		return field.ErrorList{field.Invalid(fieldPath, pattern, "must start with /")}
+	case path.Clean(pattern) != pattern:
+		return field.ErrorList{field.Invalid(fieldPath, pattern, fmt.Sprintf("must be a clean path, e.g. %s", path.Clean(pattern)))}
+	}
+	return nil
+}
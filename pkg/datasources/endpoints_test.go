@@ -0,0 +1,46 @@
+package datasources
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowsRequest(t *testing.T) {
+	prometheus := &DataSource{Spec: DatasourceSpec{Plugin: DatasourcePlugin{Kind: "PrometheusDatasource"}}}
+	overridden := &DataSource{Spec: DatasourceSpec{Plugin: DatasourcePlugin{
+		Kind: PluginKindPrometheus,
+		Spec: DatasourcePluginSpec{AllowedEndpoints: []Endpoint{{Path: "/api/v1/status/*"}}},
+	}}}
+	unknown := &DataSource{}
+
+	tests := []struct {
+		datasource *DataSource
+		method     string
+		path       string
+		allowed    bool
+	}{
+		{datasource: prometheus, method: http.MethodGet, path: "/api/v1/query", allowed: true},
+		{datasource: prometheus, method: http.MethodPost, path: "/api/v1/query_range", allowed: true},
+		{datasource: prometheus, method: http.MethodGet, path: "/api/v1/label/namespace/values", allowed: true},
+		{datasource: prometheus, method: http.MethodPost, path: "/api/v1/label/namespace/values", allowed: false},
+		{datasource: prometheus, method: http.MethodGet, path: "/api/v1/label//values", allowed: false},
+		{datasource: prometheus, method: http.MethodDelete, path: "/api/v1/query", allowed: false},
+		{datasource: prometheus, method: http.MethodPost, path: "/api/v1/admin/tsdb/delete_series", allowed: false},
+		{datasource: prometheus, method: http.MethodPost, path: "/-/quit", allowed: false},
+		{datasource: prometheus, method: http.MethodGet, path: "/api/v1/query/../admin/tsdb/snapshot", allowed: false},
+		{datasource: prometheus, method: http.MethodGet, path: "/api/v1/query/", allowed: false},
+		{datasource: prometheus, method: http.MethodGet, path: "", allowed: false},
+		{datasource: overridden, method: http.MethodGet, path: "/api/v1/status/config", allowed: true},
+		{datasource: overridden, method: http.MethodPost, path: "/api/v1/status/config", allowed: false},
+		{datasource: overridden, method: http.MethodGet, path: "/api/v1/query", allowed: false},
+		{datasource: unknown, method: http.MethodGet, path: "/api/v1/query", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			require.Equal(t, tt.allowed, tt.datasource.AllowsRequest(tt.method, tt.path))
+		})
+	}
+}
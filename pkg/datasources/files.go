@@ -0,0 +1,271 @@
+package datasources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// datasourceFileCASuffix replaces the extension of a datasource file to name
+// the file holding its CA, e.g. prometheus.yaml and prometheus.ca.crt.
+const datasourceFileCASuffix = ".ca.crt"
+
+// isDatasourceFile reports whether the file name is a datasource definition.
+// Hidden files are skipped, which also skips the timestamped directories of
+// mounted ConfigMaps and Secrets.
+func isDatasourceFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func datasourceCAFile(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + datasourceFileCASuffix
+}
+
+// loadedFile is what the provider last reported for a datasource file.
+type loadedFile struct {
+	source DatasourceSource
+	// seen is when the file was first found, it stands for the creation
+	// timestamp of the file so that editing it does not change which
+	// datasource wins a name conflict
+	seen time.Time
+}
+
+// FileProvider provides the datasources defined by the YAML files of a
+// directory, the same documents as the dashboard-datasource.yaml key of a
+// datasource ConfigMap. A CA can be given in a sibling file with the
+// .ca.crt extension. The directory is watched so that files can be added,
+// edited and removed while the server runs.
+type FileProvider struct {
+	dir    string
+	policy *Policy
+
+	events  chan DatasourceEvent
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	watcher *fsnotify.Watcher
+
+	// files is keyed by file name, it is only used by the watch goroutine
+	files map[string]*loadedFile
+}
+
+// NewFileProvider creates a provider loading the files of dir. Datasources
+// the policy does not allow are invalid.
+func NewFileProvider(dir string, policy *Policy) *FileProvider {
+	return &FileProvider{
+		dir:    dir,
+		policy: policy,
+		events: make(chan DatasourceEvent, eventsBufferSize),
+		done:   make(chan struct{}),
+		files:  map[string]*loadedFile{},
+	}
+}
+
+func (p *FileProvider) Name() string {
+	return "files"
+}
+
+func (p *FileProvider) Events() <-chan DatasourceEvent {
+	return p.events
+}
+
+func (p *FileProvider) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Error("cannot create datasources directory watcher")
+		return err
+	}
+	if err := watcher.Add(p.dir); err != nil {
+		watcher.Close()
+		log.WithError(err).Errorf("cannot watch datasources directory: %s", p.dir)
+		return err
+	}
+
+	p.watcher = watcher
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	log.Infof("watching datasources directory: %s", p.dir)
+
+	go p.watch()
+	return nil
+}
+
+func (p *FileProvider) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+}
+
+func (p *FileProvider) watch() {
+	defer close(p.done)
+	defer close(p.events)
+	defer p.watcher.Close()
+
+	p.loadAll()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case event, ok := <-p.watcher.Events:
+			if !ok {
+				return
+			}
+			p.handle(event)
+		case err, ok := <-p.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may have been dropped, reading everything again
+			// catches up with them
+			log.WithError(err).Errorf("error watching datasources directory: %s", p.dir)
+			p.loadAll()
+		}
+	}
+}
+
+func (p *FileProvider) handle(event fsnotify.Event) {
+	if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+		return
+	}
+
+	name := filepath.Base(event.Name)
+	switch {
+	case isDatasourceFile(name):
+		p.load(name)
+	case strings.HasSuffix(name, datasourceFileCASuffix):
+		for file := range p.files {
+			if datasourceCAFile(file) == name {
+				p.load(file)
+			}
+		}
+	case strings.HasPrefix(name, ".."):
+		// mounted ConfigMaps and Secrets are updated by swapping the
+		// ..data symlink, which changes every file at once
+		p.loadAll()
+	}
+}
+
+// loadAll loads every datasource file of the directory and deletes the
+// datasources of files that are gone.
+func (p *FileProvider) loadAll() {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		log.WithError(err).Errorf("cannot read datasources directory: %s", p.dir)
+		return
+	}
+
+	found := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() || !isDatasourceFile(entry.Name()) {
+			continue
+		}
+		found[entry.Name()] = true
+		p.load(entry.Name())
+	}
+	for name := range p.files {
+		if !found[name] {
+			p.load(name)
+		}
+	}
+}
+
+// load reports what the datasource file defines now, a missing file is
+// reported as deleted.
+func (p *FileProvider) load(name string) {
+	previous := p.files[name]
+
+	event, err := p.read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if previous != nil {
+			delete(p.files, name)
+			p.send(DatasourceEvent{Type: EventDeleted, Source: previous.source})
+		}
+		return
+	}
+
+	if previous == nil {
+		previous = &loadedFile{seen: time.Now()}
+		p.files[name] = previous
+		event.Type = EventAdded
+	} else if previous.source.Key() != event.Source.Key() {
+		// the namespace in the file changed, the datasource moves to
+		// another key
+		p.send(DatasourceEvent{Type: EventDeleted, Source: previous.source})
+		event.Type = EventAdded
+	} else {
+		event.Type = EventUpdated
+	}
+	previous.source = event.Source
+	event.CreationTimestamp = previous.seen
+
+	if event.Err != nil {
+		log.WithError(event.Err).Errorf("invalid datasource file: %s", filepath.Join(p.dir, name))
+	}
+	for _, warning := range event.Warnings {
+		log.Warnf("datasource file: %s: %s", filepath.Join(p.dir, name), warning)
+	}
+	p.send(event)
+}
+
+// read parses the datasource file, only a missing file is returned as an
+// error, other problems are reported in the event.
+func (p *FileProvider) read(name string) (DatasourceEvent, error) {
+	event := DatasourceEvent{
+		Source: DatasourceSource{Kind: SourceKindFile, Name: name},
+	}
+	if previous, ok := p.files[name]; ok {
+		event.Source = previous.source
+	}
+
+	data, err := os.ReadFile(filepath.Join(p.dir, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return event, err
+		}
+		event.Err = err
+		return event, nil
+	}
+
+	datasource, warnings, err := decodeDatasource(data)
+	if err != nil {
+		event.Err = &LoadError{Reason: LoadReasonParseError, Err: fmt.Errorf("cannot unmarshall datasource: %w", err)}
+		return event, nil
+	}
+	event.Warnings = warnings
+	event.Source.Namespace = datasource.Metadata.Namespace
+	if err := datasource.ValidateWithPolicy(p.policy); err != nil {
+		event.Err = &LoadError{Reason: LoadReasonInvalidDatasource, Err: err}
+		return event, nil
+	}
+	event.Datasource = datasource
+
+	ca, err := os.ReadFile(filepath.Join(p.dir, datasourceCAFile(name)))
+	switch {
+	case err == nil:
+		caValue := string(ca)
+		event.CA = &caValue
+	case !errors.Is(err, fs.ErrNotExist):
+		event.Datasource = nil
+		event.Err = fmt.Errorf("cannot read CA: %w", err)
+	}
+	return event, nil
+}
+
+func (p *FileProvider) send(event DatasourceEvent) {
+	select {
+	case p.events <- event:
+	case <-p.ctx.Done():
+	}
+}
@@ -0,0 +1,97 @@
+package datasources
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeDatasourceFile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+}
+
+func startFileProvider(t *testing.T, manager *DatasourceManager, dir string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- manager.Run(ctx, NewFileProvider(dir, nil))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
+
+func TestFileProvider_InitialFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeDatasourceFile(t, dir, "prometheus.yaml", datasourceYaml("prometheus", "https://prometheus:9091"))
+	writeDatasourceFile(t, dir, "prometheus.ca.crt", "ca-data")
+	writeDatasourceFile(t, dir, "notes.txt", datasourceYaml("ignored", "https://ignored:9091"))
+	manager := NewDatasourceManager()
+
+	startFileProvider(t, manager, dir)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus") != nil
+	}, waitTimeout, waitInterval)
+	require.Equal(t, "ca-data", *manager.GetCA("prometheus"))
+	require.Equal(t, SourceKindFile, manager.GetSource("prometheus").Kind)
+	require.Nil(t, manager.GetDatasource("ignored"))
+}
+
+func TestFileProvider_WatchChanges(t *testing.T) {
+	dir := t.TempDir()
+	manager := NewDatasourceManager()
+	startFileProvider(t, manager, dir)
+
+	writeDatasourceFile(t, dir, "prometheus.yml", datasourceYaml("prometheus", "https://prometheus:9091"))
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus") != nil
+	}, waitTimeout, waitInterval)
+
+	writeDatasourceFile(t, dir, "prometheus.yml", datasourceYaml("prometheus", "https://updated:9091"))
+	require.Eventually(t, func() bool {
+		datasource := manager.GetDatasource("prometheus")
+		return datasource != nil && datasource.Spec.Plugin.Spec.DirectURL == "https://updated:9091"
+	}, waitTimeout, waitInterval)
+
+	writeDatasourceFile(t, dir, "prometheus.ca.crt", "ca-data")
+	require.Eventually(t, func() bool {
+		ca := manager.GetCA("prometheus")
+		return ca != nil && *ca == "ca-data"
+	}, waitTimeout, waitInterval)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "prometheus.yml")))
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus") == nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestFileProvider_InvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	writeDatasourceFile(t, dir, "prometheus.yaml", datasourceYaml("prometheus", "https://prometheus:9091"))
+	manager := NewDatasourceManager()
+	startFileProvider(t, manager, dir)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus") != nil
+	}, waitTimeout, waitInterval)
+
+	writeDatasourceFile(t, dir, "prometheus.yaml", "kind: [")
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus") == nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestFileProvider_MissingDirectory(t *testing.T) {
+	manager := NewDatasourceManager()
+
+	err := manager.Run(context.Background(), NewFileProvider(filepath.Join(t.TempDir(), "missing"), nil))
+	require.Error(t, err)
+}
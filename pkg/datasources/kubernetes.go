@@ -0,0 +1,408 @@
+package datasources
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// datasourcesResyncPeriod is how often the informers replay their cache
+	// to the event handlers.
+	datasourcesResyncPeriod = 10 * time.Minute
+	// eventsBufferSize lets the informers run ahead of the manager a bit.
+	eventsBufferSize = 64
+)
+
+// WatchOptions selects the namespaces searched for datasource ConfigMaps and
+// Datasource resources.
+type WatchOptions struct {
+	// Namespaces to watch, metav1.NamespaceAll watches every namespace. When
+	// several namespaces define a datasource with the same name, requests by
+	// bare name go to the namespace listed first.
+	Namespaces []string
+	// NamespaceSelector is a label selector, when set every namespace whose
+	// labels match is watched as well.
+	NamespaceSelector string
+	// Policy makes the datasources it does not allow invalid.
+	Policy *Policy
+}
+
+func (options WatchOptions) allNamespaces() bool {
+	return options.NamespaceSelector != "" || slices.Contains(options.Namespaces, metav1.NamespaceAll)
+}
+
+// WatchDatasources watches the cluster for datasources until ctx is
+// cancelled. The dynamic client is optional, without it Datasource resources
+// are not watched.
+func (manager *DatasourceManager) WatchDatasources(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, options WatchOptions) error {
+	manager.SetNamespacePriority(options.Namespaces)
+	return manager.Run(ctx, NewKubernetesProvider(client, dynamicClient, options))
+}
+
+// namespaceLoader lists the datasource objects of one namespace and loads
+// them, used when a namespace starts matching the namespace selector.
+type namespaceLoader func(namespace string)
+
+// KubernetesProvider provides the datasources defined by labelled ConfigMaps,
+// and by Datasource resources when the CRD is installed. It runs shared
+// informers that list before they watch and relist after every reconnect, so
+// objects removed while the watch was down are reported as deletions and the
+// datasources converge to the objects that actually exist.
+type KubernetesProvider struct {
+	client        kubernetes.Interface
+	dynamicClient dynamic.Interface
+	// resourceGVR is the version of the Datasource resource watched
+	resourceGVR schema.GroupVersionResource
+	options     WatchOptions
+
+	events chan DatasourceEvent
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// known holds the sources reported and not deleted yet, so that they can
+	// be deleted when their namespace stops being watched
+	known map[string]DatasourceSource
+	// statuses holds the status last written to each ConfigMap, and
+	// loadStatuses the status each one was loaded with
+	statuses     map[string]LoadStatus
+	loadStatuses map[string]LoadStatus
+	// pendingStatuses holds the statuses queued on statusQueue and not
+	// written yet, keyed like statuses
+	pendingStatuses map[string]statusWrite
+	statusQueue     workqueue.TypedInterface[string]
+	// references holds the objects the datasource of each source
+	// references, keyed like known, and referenceWatches the watch of each
+	// of these objects
+	references       map[string][]ObjectReference
+	referenceWatches map[ObjectReference]*referenceWatch
+	// watchingReferences waits for the informers of the stopped watches
+	watchingReferences sync.WaitGroup
+	broadcaster        record.EventBroadcaster
+	recorder           record.EventRecorder
+	mutex              sync.Mutex
+}
+
+// NewKubernetesProvider creates a provider watching the namespaces selected
+// by options. The dynamic client is optional, without it Datasource resources
+// are not watched.
+func NewKubernetesProvider(client kubernetes.Interface, dynamicClient dynamic.Interface, options WatchOptions) *KubernetesProvider {
+	return &KubernetesProvider{
+		client:           client,
+		dynamicClient:    dynamicClient,
+		options:          options,
+		events:           make(chan DatasourceEvent, eventsBufferSize),
+		done:             make(chan struct{}),
+		known:            map[string]DatasourceSource{},
+		statuses:         map[string]LoadStatus{},
+		loadStatuses:     map[string]LoadStatus{},
+		pendingStatuses:  map[string]statusWrite{},
+		references:       map[string][]ObjectReference{},
+		referenceWatches: map[ObjectReference]*referenceWatch{},
+	}
+}
+
+func (p *KubernetesProvider) Name() string {
+	return "kubernetes"
+}
+
+func (p *KubernetesProvider) Events() <-chan DatasourceEvent {
+	return p.events
+}
+
+func (p *KubernetesProvider) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+}
+
+// update reports what the source defines now.
+func (p *KubernetesProvider) update(event DatasourceEvent) {
+	key := event.Source.Key()
+
+	p.mutex.Lock()
+	event.Type = EventUpdated
+	if _, ok := p.known[key]; !ok {
+		event.Type = EventAdded
+	}
+	p.known[key] = event.Source
+	p.setReferencesLocked(key, event.Datasource)
+	p.mutex.Unlock()
+
+	p.send(event)
+}
+
+// delete reports that the source is gone.
+func (p *KubernetesProvider) delete(source DatasourceSource) {
+	p.mutex.Lock()
+	delete(p.known, source.Key())
+	p.setReferencesLocked(source.Key(), nil)
+	p.mutex.Unlock()
+
+	p.send(DatasourceEvent{Type: EventDeleted, Source: source})
+}
+
+// updateObject reports the datasources an object defines now, the entries
+// it no longer defines are deleted.
+func (p *KubernetesProvider) updateObject(object DatasourceSource, events []DatasourceEvent) {
+	current := map[string]bool{}
+	for _, event := range events {
+		current[event.Source.Key()] = true
+		p.update(event)
+	}
+
+	for _, source := range p.knownEntries(object) {
+		if !current[source.Key()] {
+			p.delete(source)
+		}
+	}
+}
+
+// deleteObject reports that the object is gone along with all its entries.
+func (p *KubernetesProvider) deleteObject(object DatasourceSource) {
+	for _, source := range p.knownEntries(object) {
+		p.delete(source)
+	}
+}
+
+func (p *KubernetesProvider) knownEntries(object DatasourceSource) []DatasourceSource {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	objectKey := object.Object().Key()
+	sources := []DatasourceSource{}
+	for _, source := range p.known {
+		if source.Object().Key() == objectKey {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+func (p *KubernetesProvider) deleteNamespace(namespace string) {
+	p.mutex.Lock()
+	sources := []DatasourceSource{}
+	for _, source := range p.known {
+		if source.Namespace == namespace {
+			sources = append(sources, source)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, source := range sources {
+		p.delete(source)
+	}
+}
+
+func (p *KubernetesProvider) send(event DatasourceEvent) {
+	select {
+	case p.events <- event:
+	case <-p.ctx.Done():
+	}
+}
+
+func (p *KubernetesProvider) Start(ctx context.Context) error {
+	var namespaceSelector labels.Selector
+	if p.options.NamespaceSelector != "" {
+		var err error
+		namespaceSelector, err = labels.Parse(p.options.NamespaceSelector)
+		if err != nil {
+			log.WithError(err).Errorf("invalid namespace selector: %s", p.options.NamespaceSelector)
+			return err
+		}
+	}
+
+	p.ctx, p.cancel = context.WithCancel(ctx)
+
+	watchNamespaces := p.options.Namespaces
+	if p.options.allNamespaces() {
+		watchNamespaces = []string{metav1.NamespaceAll}
+	}
+
+	watchResources := false
+	if p.dynamicClient != nil {
+		p.resourceGVR, watchResources = datasourceResourceVersion(p.client.Discovery())
+	}
+
+	var starters []func(stopCh <-chan struct{})
+	var stoppers []func()
+	synced := []cache.InformerSynced{}
+	loaders := []namespaceLoader{}
+
+	// accept decides whether an object in the namespace is loaded, it only
+	// filters anything when watching by namespace selector
+	accept := func(namespace string) bool { return true }
+	acceptFunc := func(namespace string) bool { return accept(namespace) }
+
+	for _, namespace := range watchNamespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(p.client, datasourcesResyncPeriod,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = datasourceLabelSelector.String()
+			}),
+		)
+		configMaps := factory.Core().V1().ConfigMaps()
+		informer := configMaps.Informer()
+		if _, err := informer.AddEventHandler(p.configMapHandler(acceptFunc)); err != nil {
+			log.WithError(err).Error("cannot register datasources event handler")
+			p.cancel()
+			return err
+		}
+		loaders = append(loaders, func(namespace string) {
+			list, err := configMaps.Lister().ConfigMaps(namespace).List(labels.Everything())
+			if err != nil {
+				log.WithError(err).Errorf("cannot list datasources in namespace: %s", namespace)
+				return
+			}
+			for _, configMap := range list {
+				p.loadConfigMap(configMap)
+			}
+		})
+		starters = append(starters, factory.Start)
+		stoppers = append(stoppers, factory.Shutdown)
+		synced = append(synced, informer.HasSynced)
+
+		if !watchResources {
+			continue
+		}
+
+		dynamicFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(p.dynamicClient, datasourcesResyncPeriod, namespace, nil)
+		resources := dynamicFactory.ForResource(p.resourceGVR)
+		resourceInformer := resources.Informer()
+		if _, err := resourceInformer.AddEventHandler(p.datasourceResourceHandler(acceptFunc)); err != nil {
+			log.WithError(err).Error("cannot register Datasource resources event handler")
+			p.cancel()
+			return err
+		}
+		loaders = append(loaders, func(namespace string) {
+			list, err := resources.Lister().ByNamespace(namespace).List(labels.Everything())
+			if err != nil {
+				log.WithError(err).Errorf("cannot list Datasource resources in namespace: %s", namespace)
+				return
+			}
+			for _, obj := range list {
+				p.loadDatasourceResource(obj)
+			}
+		})
+		starters = append(starters, dynamicFactory.Start)
+		stoppers = append(stoppers, dynamicFactory.Shutdown)
+		synced = append(synced, resourceInformer.HasSynced)
+	}
+
+	if namespaceSelector != nil {
+		factory := informers.NewSharedInformerFactoryWithOptions(p.client, datasourcesResyncPeriod,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = namespaceSelector.String()
+			}),
+		)
+		namespaces := factory.Core().V1().Namespaces()
+		informer := namespaces.Informer()
+		if _, err := informer.AddEventHandler(p.namespaceHandler(loaders)); err != nil {
+			log.WithError(err).Error("cannot register namespaces event handler")
+			p.cancel()
+			return err
+		}
+		accept = func(namespace string) bool {
+			if slices.Contains(p.options.Namespaces, namespace) {
+				return true
+			}
+			_, err := namespaces.Lister().Get(namespace)
+			return err == nil
+		}
+		starters = append(starters, factory.Start)
+		stoppers = append(stoppers, factory.Shutdown)
+		synced = append(synced, informer.HasSynced)
+	}
+
+	p.broadcaster = record.NewBroadcaster()
+	p.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: p.client.CoreV1().Events(metav1.NamespaceAll)})
+	p.recorder = p.broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventsComponent})
+	p.statusQueue = workqueue.NewTyped[string]()
+	statusesWritten := make(chan struct{})
+	go func() {
+		defer close(statusesWritten)
+		p.writeStatuses()
+	}()
+
+	log.WithField("namespaces", p.options.Namespaces).WithField("namespace_selector", p.options.NamespaceSelector).Info("watching datasources")
+
+	for _, start := range starters {
+		start(p.ctx.Done())
+	}
+
+	go func() {
+		defer close(p.done)
+		defer close(p.events)
+		defer p.broadcaster.Shutdown()
+		defer func() {
+			p.statusQueue.ShutDown()
+			<-statusesWritten
+		}()
+		defer p.stopReferenceWatches()
+		defer func() {
+			for _, stop := range stoppers {
+				stop()
+			}
+		}()
+
+		// WaitForCacheSync only gives up once the provider is stopped, which
+		// is a regular shutdown rather than an error.
+		if cache.WaitForCacheSync(p.ctx.Done(), synced...) {
+			log.Info("datasources synced")
+		}
+		<-p.ctx.Done()
+	}()
+
+	return nil
+}
+
+// namespaceHandler loads the datasources of namespaces as they start
+// matching the namespace selector and drops them once they stop matching,
+// unless the namespace is also listed explicitly.
+func (p *KubernetesProvider) namespaceHandler(loaders []namespaceLoader) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			namespace, ok := obj.(*v1.Namespace)
+			if !ok {
+				log.Debugf("failed when added %v", obj)
+				return
+			}
+			for _, load := range loaders {
+				load(namespace.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			namespace, ok := obj.(*v1.Namespace)
+			if !ok {
+				log.Debugf("failed when deleted %v", obj)
+				return
+			}
+			if slices.Contains(p.options.Namespaces, namespace.Name) {
+				return
+			}
+			p.deleteNamespace(namespace.Name)
+			log.WithField("namespace", namespace.Name).Info("namespace no longer watched for datasources")
+		},
+	}
+}
@@ -0,0 +1,200 @@
+package datasources
+
+import (
+	"context"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// referenceGetTimeout bounds the reads of referenced objects from the API
+// server, done while their watch is starting.
+const referenceGetTimeout = 5 * time.Second
+
+// referenceWatch watches a single Secret or ConfigMap referenced by
+// datasources, it is stopped once no datasource references it anymore. The
+// plugin never lists or watches the Secrets it was not pointed at.
+type referenceWatch struct {
+	informer cache.SharedIndexInformer
+	stop     chan struct{}
+}
+
+// setReferencesLocked records the objects the datasource of the source
+// references, none when nil, and starts or stops the watches accordingly.
+func (p *KubernetesProvider) setReferencesLocked(sourceKey string, datasource *DataSource) {
+	if datasource == nil || len(datasource.References()) == 0 {
+		delete(p.references, sourceKey)
+	} else {
+		p.references[sourceKey] = datasource.References()
+	}
+
+	referenced := map[ObjectReference]bool{}
+	for _, references := range p.references {
+		for _, reference := range references {
+			referenced[reference] = true
+		}
+	}
+	for reference, watch := range p.referenceWatches {
+		if !referenced[reference] {
+			close(watch.stop)
+			delete(p.referenceWatches, reference)
+			log.Debugf("stopped watching %s", reference)
+		}
+	}
+	for reference := range referenced {
+		if _, ok := p.referenceWatches[reference]; !ok {
+			p.referenceWatches[reference] = p.watchReference(reference)
+			log.Debugf("watching %s", reference)
+		}
+	}
+}
+
+// stopReferenceWatches stops every watch when the provider stops, and waits
+// for their informers so that no event is sent afterwards.
+func (p *KubernetesProvider) stopReferenceWatches() {
+	p.mutex.Lock()
+	for reference, watch := range p.referenceWatches {
+		close(watch.stop)
+		delete(p.referenceWatches, reference)
+	}
+	p.mutex.Unlock()
+
+	p.watchingReferences.Wait()
+}
+
+// watchReference starts an informer restricted to the referenced object by
+// a field selector on its name.
+func (p *KubernetesProvider) watchReference(reference ObjectReference) *referenceWatch {
+	byName := func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", reference.Name).String()
+	}
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+
+	var informer cache.SharedIndexInformer
+	switch reference.Kind {
+	case ReferenceKindSecret:
+		informer = corev1informers.NewFilteredSecretInformer(p.client, reference.Namespace, datasourcesResyncPeriod, indexers, byName)
+	default:
+		informer = corev1informers.NewFilteredConfigMapInformer(p.client, reference.Namespace, datasourcesResyncPeriod, indexers, byName)
+	}
+	if _, err := informer.AddEventHandler(p.referenceHandler(reference)); err != nil {
+		log.WithError(err).Errorf("cannot register %s event handler", reference)
+	}
+
+	watch := &referenceWatch{informer: informer, stop: make(chan struct{})}
+	p.watchingReferences.Add(1)
+	go func() {
+		defer p.watchingReferences.Done()
+		informer.Run(watch.stop)
+	}()
+	return watch
+}
+
+// referenceHandler reports the changes to the referenced object.
+func (p *KubernetesProvider) referenceHandler(reference ObjectReference) cache.ResourceEventHandler {
+	changed := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		object, err := meta.Accessor(obj)
+		if err != nil {
+			log.Debugf("failed when changed %v", obj)
+			return
+		}
+		// the field selector already filters by name, unless the API
+		// server ignores it
+		if object.GetName() != reference.Name {
+			return
+		}
+		p.send(DatasourceEvent{Type: EventReferenceChanged, Reference: reference})
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: changed,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldObject, err := meta.Accessor(oldObj)
+			if err != nil {
+				log.Debugf("failed when modified %v", oldObj)
+				return
+			}
+			newObject, err := meta.Accessor(newObj)
+			if err != nil {
+				log.Debugf("failed when modified %v", newObj)
+				return
+			}
+			// periodic resyncs deliver unchanged objects
+			if oldObject.GetResourceVersion() == newObject.GetResourceVersion() {
+				return
+			}
+			changed(newObj)
+		},
+		DeleteFunc: changed,
+	}
+}
+
+// ResolveReference reads the referenced Secret or ConfigMap from the cache
+// of its watch, or from the API server while the watch is starting. Objects
+// no datasource references are unknown.
+func (p *KubernetesProvider) ResolveReference(reference ObjectReference) (map[string][]byte, bool) {
+	p.mutex.Lock()
+	watch, ok := p.referenceWatches[reference]
+	p.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	var obj interface{}
+	if watch.informer.HasSynced() {
+		var exists bool
+		var err error
+		obj, exists, err = watch.informer.GetStore().GetByKey(reference.Namespace + "/" + reference.Name)
+		if err != nil || !exists {
+			return nil, false
+		}
+	} else {
+		var err error
+		if obj, err = p.getReference(reference); err != nil {
+			if !apierrors.IsNotFound(err) {
+				log.WithError(err).Errorf("cannot read %s", reference)
+			}
+			return nil, false
+		}
+	}
+
+	switch object := obj.(type) {
+	case *v1.Secret:
+		return object.Data, true
+	case *v1.ConfigMap:
+		return configMapBytes(object), true
+	default:
+		return nil, false
+	}
+}
+
+func (p *KubernetesProvider) getReference(reference ObjectReference) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, referenceGetTimeout)
+	defer cancel()
+
+	if reference.Kind == ReferenceKindSecret {
+		return p.client.CoreV1().Secrets(reference.Namespace).Get(ctx, reference.Name, metav1.GetOptions{})
+	}
+	return p.client.CoreV1().ConfigMaps(reference.Namespace).Get(ctx, reference.Name, metav1.GetOptions{})
+}
+
+// configMapBytes returns the text and binary data of the ConfigMap.
+func configMapBytes(configMap *v1.ConfigMap) map[string][]byte {
+	data := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for key, value := range configMap.Data {
+		data[key] = []byte(value)
+	}
+	for key, value := range configMap.BinaryData {
+		data[key] = value
+	}
+	return data
+}
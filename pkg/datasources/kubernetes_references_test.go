@@ -0,0 +1,163 @@
+package datasources
+
+import (
+	"context"
+	"net/http/httputil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const authDatasourceYaml = `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "secured"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "https://secured:9091"
+      auth:
+        bearerToken:
+          name: "secured-token"
+          key: "token"
+`
+
+func newSecret(name string, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Data:       data,
+	}
+}
+
+func TestWatchDatasources_SecretReferences(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newDatasourceConfigMap("secured", authDatasourceYaml),
+		newSecret("secured-token", map[string][]byte{"token": []byte("first")}),
+	)
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("secured") != nil
+	}, waitTimeout, waitInterval)
+
+	selector := SecretKeySelector{Name: "secured-token", Key: "token"}
+	require.Eventually(t, func() bool {
+		value, err := manager.GetSecretKey(testNamespace, selector)
+		return err == nil && string(value) == "first"
+	}, waitTimeout, waitInterval)
+
+	// only the referenced Secret is listed and watched
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource != "secrets" {
+			continue
+		}
+		if restricted, ok := action.(k8stesting.ListAction); ok {
+			require.Equal(t, "metadata.name=secured-token", restricted.GetListRestrictions().Fields.String())
+		}
+		if restricted, ok := action.(k8stesting.WatchAction); ok {
+			require.Equal(t, "metadata.name=secured-token", restricted.GetWatchRestrictions().Fields.String())
+		}
+	}
+
+	_, err := manager.GetSecretKey(testNamespace, SecretKeySelector{Name: "secured-token", Key: "missing"})
+	require.ErrorContains(t, err, "key 'missing' not found in Secret "+testNamespace+"/secured-token")
+	_, err = manager.GetSecretKey(testNamespace, SecretKeySelector{Name: "missing", Key: "token"})
+	require.ErrorContains(t, err, "Secret "+testNamespace+"/missing not found")
+
+	// rotating the Secret drops the cached proxy
+	manager.SetProxy("secured", &httputil.ReverseProxy{})
+	secret := newSecret("secured-token", map[string][]byte{"token": []byte("second")})
+	secret.ResourceVersion = "2"
+	_, err = client.CoreV1().Secrets(testNamespace).Update(context.Background(), secret, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetProxy("secured") == nil
+	}, waitTimeout, waitInterval)
+	value, err := manager.GetSecretKey(testNamespace, selector)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(value))
+
+	// Secrets nothing references leave the proxy alone
+	manager.SetProxy("secured", &httputil.ReverseProxy{})
+	_, err = client.CoreV1().Secrets(testNamespace).Create(context.Background(), newSecret("other", nil), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Never(t, func() bool {
+		return manager.GetProxy("secured") == nil
+	}, 3*waitInterval, waitInterval)
+	_, err = manager.GetSecretKey(testNamespace, SecretKeySelector{Name: "other", Key: "token"})
+	require.ErrorContains(t, err, "Secret "+testNamespace+"/other not found")
+
+	// the Secret is no longer watched once its datasource is gone
+	require.NoError(t, client.CoreV1().ConfigMaps(testNamespace).Delete(context.Background(), "secured", metav1.DeleteOptions{}))
+	require.Eventually(t, func() bool {
+		_, err := manager.GetSecretKey(testNamespace, selector)
+		return err != nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestWatchDatasources_ConfigMapReferences(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newDatasourceConfigMap("secured", `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "secured"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "https://secured:9091"
+      tls:
+        ca:
+          configMap:
+            name: "client-cert"
+            key: "tls.crt"
+`),
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "client-cert", Namespace: testNamespace},
+			Data:       map[string]string{"tls.crt": "certificate"},
+			BinaryData: map[string][]byte{"tls.der": []byte("binary")},
+		},
+	)
+	manager := NewDatasourceManager()
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		value, err := manager.GetSecretOrConfigMapKey(testNamespace, SecretOrConfigMapKeySelector{ConfigMap: &ConfigMapKeySelector{Name: "client-cert", Key: "tls.crt"}})
+		return err == nil && string(value) == "certificate"
+	}, waitTimeout, waitInterval)
+
+	value, err := manager.GetSecretOrConfigMapKey(testNamespace, SecretOrConfigMapKeySelector{ConfigMap: &ConfigMapKeySelector{Name: "client-cert", Key: "tls.der"}})
+	require.NoError(t, err)
+	require.Equal(t, "binary", string(value))
+}
+
+func TestDataSourceReferences(t *testing.T) {
+	datasource := &DataSource{
+		Metadata: DatasourceMetadata{Name: "prometheus", Namespace: testNamespace},
+		Spec: DatasourceSpec{Plugin: DatasourcePlugin{Spec: DatasourcePluginSpec{
+			Auth: &DatasourceAuth{BasicAuth: &BasicAuth{
+				Username: SecretKeySelector{Name: "credentials", Key: "username"},
+				Password: SecretKeySelector{Name: "credentials", Key: "password"},
+			}},
+			TLS: &DatasourceTLS{
+				CA:        &SecretOrConfigMapKeySelector{ConfigMap: &ConfigMapKeySelector{Name: "service-ca", Key: "service-ca.crt"}},
+				Cert:      &SecretOrConfigMapKeySelector{ConfigMap: &ConfigMapKeySelector{Name: "client", Key: "tls.crt"}},
+				KeySecret: &SecretKeySelector{Name: "client", Key: "tls.key"},
+			},
+		}}},
+	}
+
+	require.Equal(t, []ObjectReference{
+		{Kind: ReferenceKindSecret, Namespace: testNamespace, Name: "credentials"},
+		{Kind: ReferenceKindConfigMap, Namespace: testNamespace, Name: "service-ca"},
+		{Kind: ReferenceKindConfigMap, Namespace: testNamespace, Name: "client"},
+		{Kind: ReferenceKindSecret, Namespace: testNamespace, Name: "client"},
+	}, datasource.References())
+}
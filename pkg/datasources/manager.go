@@ -1,40 +1,104 @@
 package datasources
 
 import (
-	"context"
 	"net/http/httputil"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	logrus "github.com/sirupsen/logrus"
-	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/util/yaml"
-	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 var log = logrus.WithField("module", "datasources")
 
+// DefaultNamespace is the namespace of the datasources of the built-in
+// dashboards, watched unless other namespaces are given.
+const DefaultNamespace = "openshift-config-managed"
+
 type DataSourceMap = map[string]*DataSource
 type CAMap = map[string]*string
 type ProxiesMap = map[string]*httputil.ReverseProxy
 
+// DatasourceKey returns the key a datasource loaded from the namespace is
+// stored under. Every getter of the manager accepts either this key or the
+// bare datasource name.
+func DatasourceKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// loadedSource is what the manager remembers about an object it has loaded
+// a datasource from, so that the datasource can be found again when the
+// object is renamed, emptied or deleted, and so that name conflicts between
+// objects can be resolved.
+type loadedSource struct {
+	source            DatasourceSource
+	creationTimestamp time.Time
+	datasource        *DataSource
+	ca                *string
+}
+
+func (s *loadedSource) datasourceName() string {
+	return s.datasource.Metadata.Name
+}
+
+func (s *loadedSource) datasourceKey() string {
+	return DatasourceKey(s.source.Namespace, s.datasourceName())
+}
+
+// precedes reports whether s wins a name conflict against other. The oldest
+// object wins so that the choice does not depend on event order, ties are
+// broken by kind/namespace/name.
+func (s *loadedSource) precedes(other *loadedSource) bool {
+	if !s.creationTimestamp.Equal(other.creationTimestamp) {
+		return s.creationTimestamp.Before(other.creationTimestamp)
+	}
+	return s.source.Key() < other.source.Key()
+}
+
 type DatasourceManager struct {
 	datasourceMap *DataSourceMap
 	caMap         *CAMap
 	proxiesMap    *ProxiesMap
-	mutex         *sync.Mutex
+	// sources is keyed by DatasourceSource.Key
+	sources map[string]*loadedSource
+	// owners maps a datasource key to the key of the source serving it
+	owners map[string]string
+	// conflicts maps a datasource key to the sources that declare it too but
+	// lost to the owner
+	conflicts map[string][]DatasourceSource
+	// names maps a bare datasource name to the datasource key it resolves to
+	names map[string]string
+	// namespacePriority ranks namespaces for bare name resolution, lower
+	// ranks win and unlisted namespaces come last
+	namespacePriority map[string]int
+	// reporters are the running providers that write statuses back
+	reporters []StatusReporter
+	// resolvers are the running providers that read referenced objects
+	resolvers []ReferenceResolver
+	mutex     *sync.Mutex
 }
 
 func NewDatasourceManager() *DatasourceManager {
 	return &DatasourceManager{
-		datasourceMap: &DataSourceMap{},
-		caMap:         &CAMap{},
-		proxiesMap:    &ProxiesMap{},
-		mutex:         &sync.Mutex{}}
+		datasourceMap:     &DataSourceMap{},
+		caMap:             &CAMap{},
+		proxiesMap:        &ProxiesMap{},
+		sources:           map[string]*loadedSource{},
+		owners:            map[string]string{},
+		conflicts:         map[string][]DatasourceSource{},
+		names:             map[string]string{},
+		namespacePriority: map[string]int{DefaultNamespace: 0},
+		mutex:             &sync.Mutex{}}
+}
+
+// keyLocked resolves a bare datasource name to its datasource key, any other
+// value is returned unchanged.
+func (manager *DatasourceManager) keyLocked(datasourceName string) string {
+	if key, ok := manager.names[datasourceName]; ok {
+		return key
+	}
+	return datasourceName
 }
 
 func (manager *DatasourceManager) SetDatasource(datasourceName string, datasource *DataSource) {
@@ -50,7 +114,7 @@ func (manager *DatasourceManager) GetDatasource(datasourceName string) *DataSour
 	defer func() {
 		manager.mutex.Unlock()
 	}()
-	return (*manager.datasourceMap)[datasourceName]
+	return (*manager.datasourceMap)[manager.keyLocked(datasourceName)]
 }
 
 func (manager *DatasourceManager) SetCA(datasourceName string, ca *string) {
@@ -66,7 +130,7 @@ func (manager *DatasourceManager) GetCA(datasourceName string) *string {
 	defer func() {
 		manager.mutex.Unlock()
 	}()
-	return (*manager.caMap)[datasourceName]
+	return (*manager.caMap)[manager.keyLocked(datasourceName)]
 }
 
 func (manager *DatasourceManager) GetProxy(datasourceName string) *httputil.ReverseProxy {
@@ -74,111 +138,257 @@ func (manager *DatasourceManager) GetProxy(datasourceName string) *httputil.Reve
 	defer func() {
 		manager.mutex.Unlock()
 	}()
-	return (*manager.proxiesMap)[datasourceName]
+	return (*manager.proxiesMap)[manager.keyLocked(datasourceName)]
 }
 
 func (manager *DatasourceManager) SetProxy(datasourceName string, proxy *httputil.ReverseProxy) {
 	manager.mutex.Lock()
-	(*manager.proxiesMap)[datasourceName] = proxy
+	(*manager.proxiesMap)[manager.keyLocked(datasourceName)] = proxy
 	manager.mutex.Unlock()
 }
 
+// ResetProxies drops every cached proxy so that they are recreated, e.g.
+// after a setting shared by all of them changed.
+func (manager *DatasourceManager) ResetProxies() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for key := range *manager.proxiesMap {
+		(*manager.proxiesMap)[key] = nil
+	}
+}
+
 func (manager *DatasourceManager) Delete(datasourceName string) {
 	manager.mutex.Lock()
-	delete(*manager.proxiesMap, datasourceName)
-	delete(*manager.datasourceMap, datasourceName)
-	delete(*manager.caMap, datasourceName)
+	manager.deleteLocked(manager.keyLocked(datasourceName))
 	manager.mutex.Unlock()
 }
 
-func (manager *DatasourceManager) WatchDatasources(namespace string) error {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		log.WithError(err).Error("cannot get in cluster config")
-		return err
+func (manager *DatasourceManager) deleteLocked(key string) {
+	delete(*manager.proxiesMap, key)
+	delete(*manager.datasourceMap, key)
+	delete(*manager.caMap, key)
+	delete(manager.owners, key)
+	manager.clearConflictsLocked(key)
+}
+
+// GetSource returns the object the datasource was loaded from, or nil when
+// the datasource is unknown or was not loaded by a watcher.
+func (manager *DatasourceManager) GetSource(datasourceName string) *DatasourceSource {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	loaded, ok := manager.sources[manager.owners[manager.keyLocked(datasourceName)]]
+	if !ok {
+		return nil
+	}
+	source := loaded.source
+	return &source
+}
+
+// GetStatus returns the source of the datasource together with the objects
+// that conflict with it, or nil when the datasource was not loaded by a
+// watcher.
+func (manager *DatasourceManager) GetStatus(datasourceName string) *DatasourceStatus {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	key := manager.keyLocked(datasourceName)
+	loaded, ok := manager.sources[manager.owners[key]]
+	if !ok {
+		return nil
+	}
+	return &DatasourceStatus{
+		Source:    loaded.source,
+		Conflicts: append([]DatasourceSource(nil), manager.conflicts[key]...),
+	}
+}
+
+// SetNamespacePriority sets the namespaces whose datasources win when a bare
+// datasource name is defined in several namespaces, highest priority first.
+// DefaultNamespace always comes first, so that the bare names the built-in
+// dashboards use cannot be captured by a datasource of another namespace,
+// e.g. an older one when every namespace is watched.
+func (manager *DatasourceManager) SetNamespacePriority(namespaces []string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.namespacePriority = map[string]int{DefaultNamespace: 0}
+	for _, namespace := range namespaces {
+		if _, ok := manager.namespacePriority[namespace]; !ok {
+			manager.namespacePriority[namespace] = len(manager.namespacePriority)
+		}
+	}
+	for datasourceName := range manager.names {
+		manager.resolveNameLocked(datasourceName)
+	}
+}
+
+func (manager *DatasourceManager) namespaceRankLocked(namespace string) int {
+	if rank, ok := manager.namespacePriority[namespace]; ok {
+		return rank
+	}
+	return len(manager.namespacePriority)
+}
+
+// setSource records that the source now defines the datasource, replacing
+// whatever the same source defined before. A nil datasource means the source
+// no longer defines any datasource.
+func (manager *DatasourceManager) setSource(source DatasourceSource, creationTimestamp time.Time, datasource *DataSource, ca *string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	key := source.Key()
+	affected := []string{}
+	if previous, ok := manager.sources[key]; ok {
+		affected = append(affected, previous.datasourceKey())
+		delete(manager.sources, key)
 	}
 
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.WithError(err).Error("cannot create k8s client")
-		return err
+	if datasource != nil {
+		loaded := &loadedSource{
+			source:            source,
+			creationTimestamp: creationTimestamp,
+			datasource:        datasource,
+			ca:                ca,
+		}
+		manager.sources[key] = loaded
+		if len(affected) == 0 || affected[0] != loaded.datasourceKey() {
+			affected = append(affected, loaded.datasourceKey())
+		}
 	}
 
-	labelSelector := labels.SelectorFromSet(labels.Set{"console.openshift.io/dashboard-datasource": "true"})
+	for _, datasourceKey := range affected {
+		manager.resolveLocked(datasourceKey, key)
+	}
+}
 
-	log.Info("watching datasources")
+// deleteSource forgets the source and the datasource it defined. The UID
+// guards against a stale delete removing an object recreated under the same
+// name.
+func (manager *DatasourceManager) deleteSource(source DatasourceSource) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 
-	for {
-		watcher, err := client.CoreV1().ConfigMaps(namespace).Watch(context.Background(), metav1.ListOptions{LabelSelector: labelSelector.String()})
+	key := source.Key()
+	previous, ok := manager.sources[key]
+	if !ok {
+		return
+	}
+	if source.UID != "" && previous.source.UID != "" && source.UID != previous.source.UID {
+		return
+	}
 
-		if err != nil {
-			log.WithError(err).Error("unable to create datasources watcher, will retry in 5 minutes")
-			time.Sleep(time.Minute * 5)
+	delete(manager.sources, key)
+	manager.resolveLocked(previous.datasourceKey(), key)
+}
+
+// resolveLocked picks which of the sources declaring the datasource key
+// serves it after the source under changedKey was set or deleted. The served
+// datasource, and its cached proxy, are only replaced when the winner changes
+// or the winner itself was updated, so updates to conflicting objects never
+// make the datasource flap.
+func (manager *DatasourceManager) resolveLocked(datasourceKey string, changedKey string) {
+	var winner *loadedSource
+	losers := []*loadedSource{}
+	for _, candidate := range manager.sources {
+		if candidate.datasourceKey() != datasourceKey {
 			continue
 		}
+		if winner == nil {
+			winner = candidate
+		} else if candidate.precedes(winner) {
+			losers = append(losers, winner)
+			winner = candidate
+		} else {
+			losers = append(losers, candidate)
+		}
+	}
+
+	manager.setConflictsLocked(datasourceKey, winner, losers, changedKey)
 
-		for {
-			event, open := <-watcher.ResultChan()
-			if open {
-				switch event.Type {
-				case watch.Added:
-					fallthrough
-				case watch.Modified:
-					if configMap, ok := event.Object.(*v1.ConfigMap); ok {
-						dataSourceYaml, ok := configMap.Data["dashboard-datasource.yaml"]
-						if !ok {
-							log.Errorf("key 'dashboard-datasource.yaml' not found in configMap: %s", configMap.Name)
-							continue
-						}
-
-						var configMapData DataSource
-						err := yaml.Unmarshal([]byte(dataSourceYaml), &configMapData)
-
-						if err != nil {
-							log.WithError(err).Errorf("cannot unmarshall configmap datasource in key 'dashboard-datasource.yaml': %s", configMap.Name)
-							continue
-						}
-						manager.SetDatasource(configMapData.Metadata.Name, &configMapData)
-						log.WithField("datasource_name", configMapData.Metadata.Name).Infof("datasource loaded: %s", configMapData.Metadata.Name)
-
-						caValue, ok := configMap.Data["dashboard-datasource-ca"]
-
-						if ok {
-							manager.SetCA(configMapData.Metadata.Name, &caValue)
-							log.WithField("datasource_name", configMapData.Metadata.Name).Infof("CA loaded: %s", configMapData.Metadata.Name)
-						}
-					} else {
-						log.Debugf("failed when modified %v", event.Object)
-					}
-				case watch.Deleted:
-					if configMap, ok := event.Object.(*v1.ConfigMap); ok {
-						dataSourceYaml, ok := configMap.Data["dashboard-datasource.yaml"]
-						if !ok {
-							log.Errorf("key 'dashboard-datasource.yaml' not found in configMap: %s", configMap.Name)
-							continue
-						}
-
-						var configMapData DataSource
-						err := yaml.Unmarshal([]byte(dataSourceYaml), &configMapData)
-						if err != nil {
-							log.WithError(err).Errorf("cannot unmarshall configmap: %s while beign deleted", configMap.Name)
-							continue
-						}
-
-						manager.Delete(configMapData.Metadata.Name)
-						log.WithField("datasource-name", configMapData.Metadata.Name).Infof("datasource deleted: %s", configMapData.Metadata.Name)
-					} else {
-						log.Debugf("failed when deleted %v", event.Object)
-					}
-				default:
-					// Do nothing
-				}
-			} else {
-				// watch channel exhausted, break to watch again
-				break
-			}
+	owner, owned := manager.owners[datasourceKey]
+	if winner == nil {
+		if owned {
+			manager.deleteLocked(datasourceKey)
+			_, datasourceName, _ := strings.Cut(datasourceKey, "/")
+			manager.resolveNameLocked(datasourceName)
+			log.WithField("datasource_name", datasourceKey).Infof("datasource deleted: %s", datasourceKey)
 		}
+		return
+	}
+
+	winnerKey := winner.source.Key()
+	if owned && owner == winnerKey && winnerKey != changedKey {
+		return
+	}
 
-		time.Sleep(time.Second * 10)
+	manager.owners[datasourceKey] = winnerKey
+	(*manager.datasourceMap)[datasourceKey] = winner.datasource
+	(*manager.caMap)[datasourceKey] = winner.ca
+	// Set the proxy to nil so that it will be recreated
+	(*manager.proxiesMap)[datasourceKey] = nil
+	manager.resolveNameLocked(winner.datasourceName())
+	if owned && owner != winnerKey {
+		log.WithField("datasource_name", datasourceKey).Infof("datasource %s is now served from %s", datasourceKey, winnerKey)
+	}
+}
+
+// resolveNameLocked points the bare datasource name at the served datasource
+// with that name in the highest priority namespace, the oldest one when
+// several namespaces share the same priority.
+func (manager *DatasourceManager) resolveNameLocked(datasourceName string) {
+	var best *loadedSource
+	for _, owner := range manager.owners {
+		candidate := manager.sources[owner]
+		if candidate == nil || candidate.datasourceName() != datasourceName {
+			continue
+		}
+		if best == nil {
+			best = candidate
+			continue
+		}
+		candidateRank := manager.namespaceRankLocked(candidate.source.Namespace)
+		bestRank := manager.namespaceRankLocked(best.source.Namespace)
+		if candidateRank < bestRank || (candidateRank == bestRank && candidate.precedes(best)) {
+			best = candidate
+		}
+	}
+
+	if best == nil {
+		delete(manager.names, datasourceName)
+		return
+	}
+	manager.names[datasourceName] = best.datasourceKey()
+}
+
+func (manager *DatasourceManager) clearConflictsLocked(datasourceKey string) {
+	_, datasourceName, _ := strings.Cut(datasourceKey, "/")
+	for _, conflict := range manager.conflicts[datasourceKey] {
+		datasourceConflicts.DeleteLabelValues(datasourceName, conflict.Namespace, conflict.Kind, conflict.Name)
+	}
+	delete(manager.conflicts, datasourceKey)
+}
+
+func (manager *DatasourceManager) setConflictsLocked(datasourceKey string, winner *loadedSource, losers []*loadedSource, changedKey string) {
+	manager.clearConflictsLocked(datasourceKey)
+
+	if len(losers) == 0 {
+		return
+	}
+
+	sort.Slice(losers, func(i, j int) bool {
+		return losers[i].precedes(losers[j])
+	})
+
+	winnerChanged := manager.owners[datasourceKey] != winner.source.Key()
+	conflicts := make([]DatasourceSource, 0, len(losers))
+	for _, loser := range losers {
+		conflicts = append(conflicts, loser.source)
+		datasourceConflicts.WithLabelValues(loser.datasourceName(), loser.source.Namespace, loser.source.Kind, loser.source.Name).Set(1)
+		if winnerChanged || loser.source.Key() == changedKey {
+			log.WithField("datasource_name", datasourceKey).Warnf("datasource %s in %s conflicts with %s, ignoring it", datasourceKey, loser.source.Key(), winner.source.Key())
+		}
 	}
+	manager.conflicts[datasourceKey] = conflicts
 }
@@ -0,0 +1,391 @@
+package datasources
+
+import (
+	"context"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNamespace = "test-namespace"
+	waitTimeout   = 5 * time.Second
+	waitInterval  = 10 * time.Millisecond
+)
+
+func newDatasourceConfigMap(name string, datasourceYaml string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{"console.openshift.io/dashboard-datasource": "true"},
+		},
+		Data: map[string]string{datasourceKey: datasourceYaml},
+	}
+}
+
+func datasourceYaml(name string, url string) string {
+	return `kind: "Datasource"
+metadata:
+  name: "` + name + `"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      direct_url: "` + url + `"
+`
+}
+
+func startWatch(t *testing.T, manager *DatasourceManager, client *fake.Clientset) {
+	t.Helper()
+	startWatchWithOptions(t, manager, client, WatchOptions{Namespaces: []string{testNamespace}})
+}
+
+func startWatchWithOptions(t *testing.T, manager *DatasourceManager, client *fake.Clientset, options WatchOptions) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	manager.SetNamespacePriority(options.Namespaces)
+	go func() {
+		done <- manager.Run(ctx, NewKubernetesProvider(client, nil, options))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
+
+func TestWatchDatasources_InitialList(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newDatasourceConfigMap("existing", datasourceYaml("existing-datasource", "https://existing:9091")),
+	)
+	manager := NewDatasourceManager()
+
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("existing-datasource") != nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestWatchDatasources_AddUpdateDelete(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	manager := NewDatasourceManager()
+	configMaps := client.CoreV1().ConfigMaps(testNamespace)
+
+	startWatch(t, manager, client)
+
+	configMap := newDatasourceConfigMap("prometheus", datasourceYaml("prometheus-datasource", "https://before:9091"))
+	_, err := configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus-datasource") != nil
+	}, waitTimeout, waitInterval)
+
+	configMap.ResourceVersion = "2"
+	configMap.Data[datasourceKey] = datasourceYaml("prometheus-datasource", "https://after:9091")
+	configMap.Data[datasourceCAKey] = "ca"
+	_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		datasource := manager.GetDatasource("prometheus-datasource")
+		return datasource != nil && datasource.Spec.Plugin.Spec.DirectURL == "https://after:9091" &&
+			manager.GetCA("prometheus-datasource") != nil
+	}, waitTimeout, waitInterval)
+
+	require.NoError(t, configMaps.Delete(context.Background(), "prometheus", metav1.DeleteOptions{}))
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus-datasource") == nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestWatchDatasources_IgnoresUnlabelledConfigMaps(t *testing.T) {
+	unlabelled := newDatasourceConfigMap("unlabelled", datasourceYaml("unlabelled-datasource", "https://unlabelled:9091"))
+	unlabelled.Labels = nil
+	client := fake.NewSimpleClientset(
+		unlabelled,
+		newDatasourceConfigMap("labelled", datasourceYaml("labelled-datasource", "https://labelled:9091")),
+	)
+	manager := NewDatasourceManager()
+
+	startWatch(t, manager, client)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("labelled-datasource") != nil
+	}, waitTimeout, waitInterval)
+	require.Nil(t, manager.GetDatasource("unlabelled-datasource"))
+}
+
+func TestWatchDatasources_Rename(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	manager := NewDatasourceManager()
+	configMaps := client.CoreV1().ConfigMaps(testNamespace)
+
+	startWatch(t, manager, client)
+
+	configMap := newDatasourceConfigMap("prometheus", datasourceYaml("old-name", "https://prometheus:9091"))
+	_, err := configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("old-name") != nil
+	}, waitTimeout, waitInterval)
+
+	configMap.ResourceVersion = "2"
+	configMap.Data[datasourceKey] = datasourceYaml("new-name", "https://prometheus:9091")
+	_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("new-name") != nil
+	}, waitTimeout, waitInterval)
+	require.Nil(t, manager.GetDatasource("old-name"))
+	require.Equal(t, &DatasourceSource{Kind: SourceKindConfigMap, Namespace: testNamespace, Name: "prometheus"}, manager.GetSource("new-name"))
+}
+
+func TestWatchDatasources_KeyRemoval(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	manager := NewDatasourceManager()
+	configMaps := client.CoreV1().ConfigMaps(testNamespace)
+
+	startWatch(t, manager, client)
+
+	configMap := newDatasourceConfigMap("prometheus", datasourceYaml("prometheus-datasource", "https://prometheus:9091"))
+	configMap.Data[datasourceCAKey] = "ca"
+	_, err := configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus-datasource") != nil
+	}, waitTimeout, waitInterval)
+
+	configMap.ResourceVersion = "2"
+	delete(configMap.Data, datasourceKey)
+	_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus-datasource") == nil
+	}, waitTimeout, waitInterval)
+	require.Nil(t, manager.GetCA("prometheus-datasource"))
+}
+
+func TestWatchDatasources_DeleteUnparsable(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	manager := NewDatasourceManager()
+	configMaps := client.CoreV1().ConfigMaps(testNamespace)
+
+	startWatch(t, manager, client)
+
+	configMap := newDatasourceConfigMap("prometheus", datasourceYaml("prometheus-datasource", "https://prometheus:9091"))
+	_, err := configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus-datasource") != nil
+	}, waitTimeout, waitInterval)
+
+	configMap.ResourceVersion = "2"
+	configMap.Data[datasourceKey] = "{not yaml"
+	_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, configMaps.Delete(context.Background(), "prometheus", metav1.DeleteOptions{}))
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus-datasource") == nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestDatasourceManager_DeleteSourceKeepsOtherOwner(t *testing.T) {
+	manager := NewDatasourceManager()
+	first := DatasourceSource{Namespace: testNamespace, Name: "first", UID: "1"}
+	second := DatasourceSource{Namespace: testNamespace, Name: "second", UID: "2"}
+	datasource := &DataSource{Metadata: DatasourceMetadata{Name: "shared"}}
+
+	manager.setSource(first, time.Time{}, datasource, nil)
+	manager.setSource(second, time.Time{}, datasource, nil)
+	manager.deleteSource(first)
+
+	require.NotNil(t, manager.GetDatasource("shared"))
+	require.Equal(t, &second, manager.GetSource("shared"))
+
+	// a delete for an older ConfigMap with the same name must not remove the
+	// recreated one
+	manager.deleteSource(DatasourceSource{Namespace: testNamespace, Name: "second", UID: "old"})
+	require.NotNil(t, manager.GetDatasource("shared"))
+
+	manager.deleteSource(second)
+	require.Nil(t, manager.GetDatasource("shared"))
+}
+
+func TestDatasourceManager_ConflictOldestWins(t *testing.T) {
+	older := DatasourceSource{Namespace: testNamespace, Name: "older"}
+	newer := DatasourceSource{Namespace: testNamespace, Name: "newer"}
+	olderDatasource := &DataSource{Metadata: DatasourceMetadata{Name: "shared"}, Kind: "older"}
+	newerDatasource := &DataSource{Metadata: DatasourceMetadata{Name: "shared"}, Kind: "newer"}
+	now := time.Now()
+
+	for _, newerFirst := range []bool{true, false} {
+		manager := NewDatasourceManager()
+		if newerFirst {
+			manager.setSource(newer, now, newerDatasource, nil)
+			manager.setSource(older, now.Add(-time.Hour), olderDatasource, nil)
+		} else {
+			manager.setSource(older, now.Add(-time.Hour), olderDatasource, nil)
+			manager.setSource(newer, now, newerDatasource, nil)
+		}
+
+		require.Same(t, olderDatasource, manager.GetDatasource("shared"))
+		require.Equal(t, &DatasourceStatus{
+			Source:    older,
+			Conflicts: []DatasourceSource{newer},
+		}, manager.GetStatus("shared"))
+	}
+}
+
+func TestDatasourceManager_ConflictTieBrokenByKey(t *testing.T) {
+	manager := NewDatasourceManager()
+	now := time.Now()
+	b := &DataSource{Metadata: DatasourceMetadata{Name: "shared"}, Kind: "b"}
+	a := &DataSource{Metadata: DatasourceMetadata{Name: "shared"}, Kind: "a"}
+
+	manager.setSource(DatasourceSource{Namespace: testNamespace, Name: "b"}, now, b, nil)
+	manager.setSource(DatasourceSource{Namespace: testNamespace, Name: "a"}, now, a, nil)
+
+	require.Same(t, a, manager.GetDatasource("shared"))
+}
+
+func TestDatasourceManager_ConflictDoesNotFlap(t *testing.T) {
+	manager := NewDatasourceManager()
+	older := DatasourceSource{Namespace: testNamespace, Name: "older"}
+	newer := DatasourceSource{Namespace: testNamespace, Name: "newer"}
+	now := time.Now()
+
+	manager.setSource(older, now.Add(-time.Hour), &DataSource{Metadata: DatasourceMetadata{Name: "shared"}}, nil)
+	proxy := &httputil.ReverseProxy{}
+	manager.SetProxy("shared", proxy)
+
+	// updates to the losing ConfigMap must not reset the winner's proxy
+	manager.setSource(newer, now, &DataSource{Metadata: DatasourceMetadata{Name: "shared"}}, nil)
+	manager.setSource(newer, now, &DataSource{Metadata: DatasourceMetadata{Name: "shared"}, Kind: "changed"}, nil)
+	require.Same(t, proxy, manager.GetProxy("shared"))
+	require.Equal(t, older, manager.GetStatus("shared").Source)
+
+	// the loser takes over once the winner is gone
+	manager.deleteSource(older)
+	require.Equal(t, "changed", manager.GetDatasource("shared").Kind)
+	require.Nil(t, manager.GetProxy("shared"))
+	require.Equal(t, &DatasourceStatus{Source: newer}, manager.GetStatus("shared"))
+}
+
+func newNamespacedConfigMap(namespace string, name string, datasourceYaml string) *v1.ConfigMap {
+	configMap := newDatasourceConfigMap(name, datasourceYaml)
+	configMap.Namespace = namespace
+	return configMap
+}
+
+func TestWatchDatasources_MultipleNamespaces(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newNamespacedConfigMap("team-a", "prometheus", datasourceYaml("prometheus", "https://team-a:9091")),
+		newNamespacedConfigMap("team-b", "prometheus", datasourceYaml("prometheus", "https://team-b:9091")),
+		newNamespacedConfigMap("team-c", "prometheus", datasourceYaml("prometheus", "https://team-c:9091")),
+	)
+	manager := NewDatasourceManager()
+
+	startWatchWithOptions(t, manager, client, WatchOptions{Namespaces: []string{"team-b", "team-a"}})
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource(DatasourceKey("team-a", "prometheus")) != nil &&
+			manager.GetDatasource(DatasourceKey("team-b", "prometheus")) != nil
+	}, waitTimeout, waitInterval)
+
+	require.Nil(t, manager.GetDatasource(DatasourceKey("team-c", "prometheus")))
+	require.Equal(t, "team-a", manager.GetDatasource(DatasourceKey("team-a", "prometheus")).Metadata.Namespace)
+	// same names in different namespaces are not conflicts
+	require.Empty(t, manager.GetStatus(DatasourceKey("team-a", "prometheus")).Conflicts)
+	// the bare name resolves to the namespace listed first
+	require.Equal(t, "https://team-b:9091", manager.GetDatasource("prometheus").Spec.Plugin.Spec.DirectURL)
+
+	require.NoError(t, client.CoreV1().ConfigMaps("team-b").Delete(context.Background(), "prometheus", metav1.DeleteOptions{}))
+
+	require.Eventually(t, func() bool {
+		datasource := manager.GetDatasource("prometheus")
+		return datasource != nil && datasource.Spec.Plugin.Spec.DirectURL == "https://team-a:9091"
+	}, waitTimeout, waitInterval)
+}
+
+func TestWatchDatasources_AllNamespaces(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newNamespacedConfigMap("team-a", "prometheus", datasourceYaml("team-a-prometheus", "https://team-a:9091")),
+		newNamespacedConfigMap("team-b", "prometheus", datasourceYaml("team-b-prometheus", "https://team-b:9091")),
+	)
+	manager := NewDatasourceManager()
+
+	startWatchWithOptions(t, manager, client, WatchOptions{Namespaces: []string{metav1.NamespaceAll}})
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("team-a-prometheus") != nil && manager.GetDatasource("team-b-prometheus") != nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestWatchDatasources_AllNamespacesDefaultNamespaceFirst(t *testing.T) {
+	tenant := newNamespacedConfigMap("team-a", "prometheus", datasourceYaml("cluster-prometheus-proxy", "https://team-a:9091"))
+	tenant.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	builtIn := newNamespacedConfigMap(DefaultNamespace, "prometheus", datasourceYaml("cluster-prometheus-proxy", "https://thanos-querier:9091"))
+	builtIn.CreationTimestamp = metav1.Now()
+	client := fake.NewSimpleClientset(tenant, builtIn)
+	manager := NewDatasourceManager()
+
+	startWatchWithOptions(t, manager, client, WatchOptions{Namespaces: []string{metav1.NamespaceAll}})
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource(DatasourceKey("team-a", "cluster-prometheus-proxy")) != nil &&
+			manager.GetDatasource(DatasourceKey(DefaultNamespace, "cluster-prometheus-proxy")) != nil
+	}, waitTimeout, waitInterval)
+	// the older tenant datasource does not capture the bare name
+	require.Equal(t, "https://thanos-querier:9091", manager.GetDatasource("cluster-prometheus-proxy").Spec.Plugin.Spec.DirectURL)
+}
+
+func TestWatchDatasources_NamespaceSelector(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "selected", Labels: map[string]string{"dashboards": "true"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+		newNamespacedConfigMap("selected", "prometheus", datasourceYaml("selected-prometheus", "https://selected:9091")),
+		newNamespacedConfigMap("other", "prometheus", datasourceYaml("other-prometheus", "https://other:9091")),
+		newNamespacedConfigMap(testNamespace, "prometheus", datasourceYaml("listed-prometheus", "https://listed:9091")),
+	)
+	manager := NewDatasourceManager()
+
+	startWatchWithOptions(t, manager, client, WatchOptions{
+		Namespaces:        []string{testNamespace},
+		NamespaceSelector: "dashboards=true",
+	})
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("selected-prometheus") != nil && manager.GetDatasource("listed-prometheus") != nil
+	}, waitTimeout, waitInterval)
+	require.Nil(t, manager.GetDatasource("other-prometheus"))
+
+	require.NoError(t, client.CoreV1().Namespaces().Delete(context.Background(), "selected", metav1.DeleteOptions{}))
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("selected-prometheus") == nil
+	}, waitTimeout, waitInterval)
+	require.NotNil(t, manager.GetDatasource("listed-prometheus"))
+}
+
+func TestWatchDatasources_InvalidNamespaceSelector(t *testing.T) {
+	manager := NewDatasourceManager()
+
+	err := manager.Run(context.Background(), NewKubernetesProvider(fake.NewSimpleClientset(), nil, WatchOptions{NamespaceSelector: "!!"}))
+	require.Error(t, err)
+}
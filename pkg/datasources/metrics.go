@@ -0,0 +1,15 @@
+package datasources
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var datasourceConflicts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "console_dashboards_plugin",
+	Name:      "datasource_conflicts",
+	Help:      "Set to 1 for every ConfigMap or Datasource resource whose datasource is ignored because an older object declares the same datasource name.",
+}, []string{"datasource", "namespace", "kind", "name"})
+
+func init() {
+	prometheus.MustRegister(datasourceConflicts)
+}
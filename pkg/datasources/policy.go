@@ -0,0 +1,227 @@
+package datasources
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Policy holds the restrictions the backend puts on the datasources it
+// loads, set with its flags. The datasources breaking them are invalid. A nil
+// policy leaves the URLs unrestricted, refuses the service-account auth mode
+// and allows the forward-user-token one only in DefaultNamespace.
+type Policy struct {
+	// URLs, when set, restricts the URLs datasources may target.
+	URLs *URLPolicy
+	// DisallowInsecureSkipVerify refuses the datasources disabling the
+	// verification of the certificate of their upstream.
+	DisallowInsecureSkipVerify bool
+	// ServiceAccountAuth allows the service-account auth mode, which sends
+	// the token of the backend to the datasource, to the datasources of
+	// the trusted namespaces: DefaultNamespace and ServiceAccountNamespaces.
+	// Whoever can create a datasource elsewhere would otherwise query any
+	// upstream with the permissions of the backend.
+	ServiceAccountAuth       bool
+	ServiceAccountNamespaces []string
+	// ForwardUserTokenNamespaces and ForwardUserTokenUpstreams allow the
+	// forward-user-token auth mode, which sends the bearer token of the
+	// console user to the datasource, outside DefaultNamespace: to the
+	// datasources of the listed namespaces and to the ones targeting the
+	// listed upstreams, given as host or host:port. Whoever can create a
+	// datasource elsewhere would otherwise collect the tokens of every user
+	// opening a dashboard.
+	ForwardUserTokenNamespaces []string
+	ForwardUserTokenUpstreams  []string
+	// RequireNamespaceLabel requires namespaceLabel from the datasources
+	// outside the trusted namespaces: DefaultNamespace and
+	// NamespaceLabelExemptNamespaces. NamespaceLabelUpstreams requires it
+	// only from the ones targeting the listed hosts, given as host or
+	// host:port, the shared upstreams such as the cluster Thanos Querier
+	// serving the series of every namespace. Since a shared upstream can
+	// also be reached through its IP or another host name, the proxy
+	// refuses to connect the other datasources to the addresses the
+	// upstreams resolve to.
+	RequireNamespaceLabel          bool
+	NamespaceLabelUpstreams        []string
+	NamespaceLabelExemptNamespaces []string
+}
+
+func (policy *Policy) urlPolicy() *URLPolicy {
+	if policy == nil {
+		return nil
+	}
+	return policy.URLs
+}
+
+// allowsServiceAccount reports whether the datasources of the namespace may
+// use the service-account auth mode.
+func (policy *Policy) allowsServiceAccount(namespace string) bool {
+	if policy == nil || !policy.ServiceAccountAuth {
+		return false
+	}
+	return namespace == DefaultNamespace || slices.Contains(policy.ServiceAccountNamespaces, namespace)
+}
+
+// allowsForwardUserToken reports whether the datasource may use the
+// forward-user-token auth mode.
+func (policy *Policy) allowsForwardUserToken(datasource *DataSource) bool {
+	namespace := datasource.Metadata.Namespace
+	if namespace == DefaultNamespace {
+		return true
+	}
+	if policy == nil {
+		return false
+	}
+	return (namespace != "" && slices.Contains(policy.ForwardUserTokenNamespaces, namespace)) ||
+		matchesUpstream(datasource.Spec.Plugin.Spec.DirectURL, policy.ForwardUserTokenUpstreams)
+}
+
+// requiresNamespaceLabel reports whether the datasource must restrict its
+// queries to its namespace. The datasources without namespace, which only
+// files define, are not trusted either.
+func (policy *Policy) requiresNamespaceLabel(datasource *DataSource) bool {
+	if policy == nil {
+		return false
+	}
+	if policy.exemptFromNamespaceLabel(datasource.Metadata.Namespace) {
+		return false
+	}
+	return policy.RequireNamespaceLabel || matchesUpstream(datasource.Spec.Plugin.Spec.DirectURL, policy.NamespaceLabelUpstreams)
+}
+
+func (policy *Policy) exemptFromNamespaceLabel(namespace string) bool {
+	return namespace != "" && (namespace == DefaultNamespace || slices.Contains(policy.NamespaceLabelExemptNamespaces, namespace))
+}
+
+// GuardsSharedUpstreams reports whether the connections of the datasource
+// must be checked with CheckSharedUpstreamDial, the datasource being allowed
+// without namespaceLabel as long as it does not reach a shared upstream.
+func (policy *Policy) GuardsSharedUpstreams(datasource *DataSource) bool {
+	return policy != nil && len(policy.NamespaceLabelUpstreams) > 0 &&
+		datasource.Spec.Plugin.Spec.NamespaceLabel == nil && !policy.exemptFromNamespaceLabel(datasource.Metadata.Namespace)
+}
+
+// UpstreamAddress is an address a shared upstream resolves to, on any port
+// when Port is empty.
+type UpstreamAddress struct {
+	IP   net.IP
+	Port string
+}
+
+// SharedUpstreamAddresses resolves NamespaceLabelUpstreams. The hosts that do
+// not resolve are left out, no datasource can reach them either.
+func (policy *Policy) SharedUpstreamAddresses(ctx context.Context) []UpstreamAddress {
+	addresses := []UpstreamAddress{}
+	for _, upstream := range policy.NamespaceLabelUpstreams {
+		host, port := splitUpstream(upstream)
+		if ip := net.ParseIP(host); ip != nil {
+			addresses = append(addresses, UpstreamAddress{IP: ip, Port: port})
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			log.WithError(err).Debugf("cannot resolve the shared upstream %s", upstream)
+			continue
+		}
+		for _, ip := range ips {
+			addresses = append(addresses, UpstreamAddress{IP: ip.IP, Port: port})
+		}
+	}
+	return addresses
+}
+
+// CheckSharedUpstreamDial refuses to connect to one of the addresses of the
+// shared upstreams, right before connecting to it.
+func CheckSharedUpstreamDial(addresses []UpstreamAddress, host string, ip net.IP, port string) error {
+	for _, address := range addresses {
+		if address.IP.Equal(ip) && (address.Port == "" || address.Port == port) {
+			return fmt.Errorf("address %s of host %q is a shared upstream, which requires namespaceLabel", ip, host)
+		}
+	}
+	return nil
+}
+
+// splitUpstream splits an upstream given as host or host:port.
+func splitUpstream(upstream string) (string, string) {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return strings.Trim(upstream, "[]"), ""
+	}
+	return host, port
+}
+
+// serviceHost normalizes the names a service answers to, name.namespace,
+// name.namespace.svc and name.namespace.svc followed by the cluster domain,
+// to name.namespace.svc. Other host names are only lowercased.
+func serviceHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	switch {
+	case len(labels) == 2:
+		return host + ".svc"
+	case len(labels) > 3 && labels[2] == "svc":
+		return strings.Join(labels[:3], ".")
+	}
+	return host
+}
+
+// matchesUpstream reports whether the URL targets one of the upstreams, given
+// as host or host:port, comparing the service host names by serviceHost. The
+// entries without port match any port.
+func matchesUpstream(directURL string, upstreams []string) bool {
+	if len(upstreams) == 0 {
+		return false
+	}
+	parsed, err := url.Parse(directURL)
+	if err != nil {
+		return false
+	}
+	host := serviceHost(parsed.Hostname())
+	port := parsed.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[parsed.Scheme]
+	}
+	for _, upstream := range upstreams {
+		upstreamHost, upstreamPort := splitUpstream(upstream)
+		if serviceHost(upstreamHost) == host && (upstreamPort == "" || upstreamPort == port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (datasource *DataSource) validatePolicy(policy *Policy) field.ErrorList {
+	errs := datasource.validateURLPolicy(policy.urlPolicy())
+
+	tlsSpec := datasource.Spec.Plugin.Spec.TLS
+	if policy != nil && policy.DisallowInsecureSkipVerify && tlsSpec != nil && tlsSpec.InsecureSkipVerify {
+		errs = append(errs, field.Forbidden(field.NewPath("spec", "plugin", "spec", "tls", "insecureSkipVerify"), "insecureSkipVerify is disallowed on this cluster"))
+	}
+
+	auth := datasource.Spec.Plugin.Spec.Auth
+	if auth != nil && auth.Mode == AuthModeServiceAccount && !policy.allowsServiceAccount(datasource.Metadata.Namespace) {
+		modePath := field.NewPath("spec", "plugin", "spec", "auth", "mode")
+		if policy == nil || !policy.ServiceAccountAuth {
+			errs = append(errs, field.Forbidden(modePath, "the service-account auth mode is not enabled on the backend"))
+		} else {
+			errs = append(errs, field.Forbidden(modePath, fmt.Sprintf("the service-account auth mode is not allowed in namespace %q", datasource.Metadata.Namespace)))
+		}
+	}
+
+	if auth != nil && auth.Mode == AuthModeForwardUserToken && !policy.allowsForwardUserToken(datasource) {
+		errs = append(errs, field.Forbidden(field.NewPath("spec", "plugin", "spec", "auth", "mode"), fmt.Sprintf("the forward-user-token auth mode is not allowed in namespace %q for this URL", datasource.Metadata.Namespace)))
+	}
+
+	if datasource.Spec.Plugin.Spec.NamespaceLabel == nil && policy.requiresNamespaceLabel(datasource) {
+		errs = append(errs, field.Required(field.NewPath("spec", "plugin", "spec", "namespaceLabel"), "the backend requires the queries of this datasource to be restricted to its namespace"))
+	}
+	return errs
+}
@@ -0,0 +1,184 @@
+package datasources
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPolicy_ServiceAccountAuth(t *testing.T) {
+	serviceAccountConfigMap := func(namespace string) *v1.ConfigMap {
+		return &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "datasource", Namespace: namespace},
+			Data: map[string]string{datasourceKey: `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "https://thanos-querier.openshift-monitoring.svc:9091"
+      auth:
+        mode: "service-account"
+`},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		policy    *Policy
+		namespace string
+		err       string
+	}{
+		{name: "no policy", namespace: DefaultNamespace, err: "spec.plugin.spec.auth.mode: Forbidden: the service-account auth mode is not enabled on the backend"},
+		{name: "not enabled", policy: &Policy{ServiceAccountNamespaces: []string{"team-a"}}, namespace: "team-a", err: "not enabled on the backend"},
+		{name: "default namespace", policy: &Policy{ServiceAccountAuth: true}, namespace: DefaultNamespace},
+		{name: "listed namespace", policy: &Policy{ServiceAccountAuth: true, ServiceAccountNamespaces: []string{"team-a"}}, namespace: "team-a"},
+		{name: "other namespace", policy: &Policy{ServiceAccountAuth: true, ServiceAccountNamespaces: []string{"team-a"}}, namespace: "team-b", err: `the service-account auth mode is not allowed in namespace "team-b"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := configMapEvents(serviceAccountConfigMap(tt.namespace), tt.policy)
+			require.Len(t, events, 1)
+			if tt.err != "" {
+				require.ErrorContains(t, events[0].Err, tt.err)
+				require.Nil(t, events[0].Datasource)
+				return
+			}
+			require.NoError(t, events[0].Err)
+			require.NotNil(t, events[0].Datasource)
+		})
+	}
+}
+
+func TestPolicy_RequireNamespaceLabel(t *testing.T) {
+	datasource := func(namespace string, directURL string, namespaceLabel bool) *DataSource {
+		datasource := &DataSource{
+			APIVersion: "console.openshift.io/v1beta1",
+			Kind:       "Datasource",
+			Metadata:   DatasourceMetadata{Name: "prometheus", Namespace: namespace},
+			Spec: DatasourceSpec{Plugin: DatasourcePlugin{
+				Kind: PluginKindPrometheus,
+				Spec: DatasourcePluginSpec{DirectURL: directURL},
+			}},
+		}
+		if namespaceLabel {
+			datasource.Spec.Plugin.Spec.NamespaceLabel = &NamespaceLabelEnforcement{}
+		}
+		return datasource
+	}
+	const thanos = "https://thanos-querier.openshift-monitoring.svc:9091"
+	upstreams := &Policy{NamespaceLabelUpstreams: []string{"thanos-querier.openshift-monitoring.svc:9091", "prometheus.shared.svc"}}
+
+	tests := []struct {
+		name       string
+		policy     *Policy
+		datasource *DataSource
+		err        bool
+	}{
+		{name: "no policy", datasource: datasource("team-a", thanos, false)},
+		{name: "required", policy: &Policy{RequireNamespaceLabel: true}, datasource: datasource("team-a", "https://prometheus.team-a.svc", false), err: true},
+		{name: "required and set", policy: &Policy{RequireNamespaceLabel: true}, datasource: datasource("team-a", "https://prometheus.team-a.svc", true)},
+		{name: "default namespace", policy: &Policy{RequireNamespaceLabel: true}, datasource: datasource(DefaultNamespace, thanos, false)},
+		{name: "exempt namespace", policy: &Policy{RequireNamespaceLabel: true, NamespaceLabelExemptNamespaces: []string{"team-a"}}, datasource: datasource("team-a", thanos, false)},
+		{name: "no namespace", policy: &Policy{RequireNamespaceLabel: true}, datasource: datasource("", "https://prometheus.team-a.svc", false), err: true},
+		{name: "shared upstream", policy: upstreams, datasource: datasource("team-a", thanos, false), err: true},
+		{name: "shared upstream host case", policy: upstreams, datasource: datasource("team-a", "https://Thanos-Querier.openshift-monitoring.svc.:9091/", false), err: true},
+		{name: "shared upstream any port", policy: upstreams, datasource: datasource("team-a", "http://prometheus.shared.svc:9090", false), err: true},
+		{name: "shared upstream default port", policy: &Policy{NamespaceLabelUpstreams: []string{"prometheus.shared.svc:443"}}, datasource: datasource("team-a", "https://prometheus.shared.svc", false), err: true},
+		{name: "shared upstream and set", policy: upstreams, datasource: datasource("team-a", thanos, true)},
+		{name: "cluster domain alias", policy: upstreams, datasource: datasource("team-a", "https://thanos-querier.openshift-monitoring.svc.cluster.local:9091", false), err: true},
+		{name: "namespace alias", policy: upstreams, datasource: datasource("team-a", "https://thanos-querier.openshift-monitoring:9091", false), err: true},
+		{name: "listed as alias", policy: &Policy{NamespaceLabelUpstreams: []string{"prometheus.shared.svc.cluster.local."}}, datasource: datasource("team-a", "http://prometheus.shared:9090", false), err: true},
+		{name: "listed IP", policy: &Policy{NamespaceLabelUpstreams: []string{"[fd00::1]:9091", "172.30.0.10"}}, datasource: datasource("team-a", "https://[fd00::1]:9091", false), err: true},
+		{name: "other service", policy: upstreams, datasource: datasource("team-a", "https://thanos-querier.team-a.svc.cluster.local:9091", false)},
+		{name: "other port", policy: upstreams, datasource: datasource("team-a", "https://thanos-querier.openshift-monitoring.svc:9092", false)},
+		{name: "other upstream", policy: upstreams, datasource: datasource("team-a", "https://prometheus.team-a.svc", false)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.datasource.ValidateWithPolicy(tt.policy)
+			if tt.err {
+				require.ErrorContains(t, err, "spec.plugin.spec.namespaceLabel: Required value: the backend requires the queries of this datasource to be restricted to its namespace")
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestPolicy_ForwardUserToken(t *testing.T) {
+	datasource := func(namespace string, directURL string) *DataSource {
+		return &DataSource{
+			APIVersion: "console.openshift.io/v1beta1",
+			Kind:       "Datasource",
+			Metadata:   DatasourceMetadata{Name: "prometheus", Namespace: namespace},
+			Spec: DatasourceSpec{Plugin: DatasourcePlugin{
+				Kind: PluginKindPrometheus,
+				Spec: DatasourcePluginSpec{
+					DirectURL: directURL,
+					Auth:      &DatasourceAuth{Mode: AuthModeForwardUserToken},
+				},
+			}},
+		}
+	}
+	const thanos = "https://thanos-querier.openshift-monitoring.svc:9092"
+
+	tests := []struct {
+		name       string
+		policy     *Policy
+		datasource *DataSource
+		err        bool
+	}{
+		{name: "default namespace", datasource: datasource(DefaultNamespace, "https://attacker.example.com")},
+		{name: "no policy", datasource: datasource("team-a", thanos), err: true},
+		{name: "other namespace", policy: &Policy{}, datasource: datasource("team-a", "https://attacker.example.com"), err: true},
+		{name: "listed namespace", policy: &Policy{ForwardUserTokenNamespaces: []string{"team-a"}}, datasource: datasource("team-a", "https://attacker.example.com")},
+		{name: "listed upstream", policy: &Policy{ForwardUserTokenUpstreams: []string{"thanos-querier.openshift-monitoring.svc:9092"}}, datasource: datasource("team-a", thanos)},
+		{name: "other upstream port", policy: &Policy{ForwardUserTokenUpstreams: []string{"thanos-querier.openshift-monitoring.svc:9092"}}, datasource: datasource("team-a", "https://thanos-querier.openshift-monitoring.svc:9091"), err: true},
+		{name: "no namespace", policy: &Policy{ForwardUserTokenNamespaces: []string{""}}, datasource: datasource("", "https://attacker.example.com"), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.datasource.ValidateWithPolicy(tt.policy)
+			if tt.err {
+				require.ErrorContains(t, err, "spec.plugin.spec.auth.mode: Forbidden: the forward-user-token auth mode is not allowed in namespace")
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestPolicy_DisallowInsecureSkipVerify(t *testing.T) {
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "datasource", Namespace: "team-a"},
+		Data: map[string]string{datasourceKey: `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "https://prometheus.team-a.svc:9091"
+      tls:
+        insecureSkipVerify: true
+`},
+	}
+
+	events := configMapEvents(configMap, &Policy{DisallowInsecureSkipVerify: true})
+	require.Len(t, events, 1)
+	require.ErrorContains(t, events[0].Err, "spec.plugin.spec.tls.insecureSkipVerify: Forbidden: insecureSkipVerify is disallowed on this cluster")
+	require.Nil(t, events[0].Datasource)
+
+	events = configMapEvents(configMap, &Policy{})
+	require.Len(t, events, 1)
+	require.NoError(t, events[0].Err)
+}
@@ -0,0 +1,147 @@
+package datasources
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventAdded   EventType = "Added"
+	EventUpdated EventType = "Updated"
+	EventDeleted EventType = "Deleted"
+	// EventReferenceChanged reports that an object datasources may
+	// reference, named by Reference, was added, updated or deleted.
+	EventReferenceChanged EventType = "ReferenceChanged"
+)
+
+// DatasourceEvent reports what one source object defines after it was added,
+// updated or deleted.
+type DatasourceEvent struct {
+	Type   EventType
+	Source DatasourceSource
+	// CreationTimestamp of the source, used to resolve name conflicts
+	CreationTimestamp time.Time
+	// Datasource is nil when the source no longer defines a datasource that
+	// can be served, Err then tells why.
+	Datasource *DataSource
+	CA         *string
+	Err        error
+	// Warnings are problems that did not prevent loading the datasource,
+	// such as unknown fields.
+	Warnings []string
+	// Reference is the object that changed for EventReferenceChanged
+	// events.
+	Reference ObjectReference
+}
+
+// DatasourceProvider feeds the manager with datasources from one kind of
+// storage.
+type DatasourceProvider interface {
+	// Name identifies the provider in logs.
+	Name() string
+	// Start begins watching for datasources without blocking. Events are
+	// produced until ctx is cancelled or Stop is called.
+	Start(ctx context.Context) error
+	// Stop stops the provider and waits for it, the events channel is
+	// closed once it returns.
+	Stop()
+	// Events delivers the changes seen by the provider. Sources that
+	// already exist when the provider starts are delivered as added.
+	Events() <-chan DatasourceEvent
+}
+
+// Run starts the providers and applies their events until ctx is cancelled,
+// then stops them. It fails without running anything when a provider cannot
+// start.
+func (manager *DatasourceManager) Run(ctx context.Context, providers ...DatasourceProvider) error {
+	for i, provider := range providers {
+		if err := provider.Start(ctx); err != nil {
+			log.WithError(err).Errorf("cannot start datasource provider: %s", provider.Name())
+			for _, started := range providers[:i] {
+				started.Stop()
+			}
+			return err
+		}
+		log.Infof("datasource provider started: %s", provider.Name())
+	}
+
+	manager.addProviders(providers)
+	defer manager.removeProviders(providers)
+
+	var wg sync.WaitGroup
+	for _, provider := range providers {
+		wg.Add(1)
+		go func(provider DatasourceProvider) {
+			defer wg.Done()
+			for event := range provider.Events() {
+				manager.Apply(event)
+			}
+		}(provider)
+	}
+
+	<-ctx.Done()
+	for _, provider := range providers {
+		provider.Stop()
+	}
+	wg.Wait()
+	return nil
+}
+
+// Apply updates the datasources with an event of a provider.
+func (manager *DatasourceManager) Apply(event DatasourceEvent) {
+	switch event.Type {
+	case EventAdded, EventUpdated:
+		manager.setSource(event.Source, event.CreationTimestamp, event.Datasource, event.CA)
+		if event.Datasource == nil {
+			return
+		}
+		key := DatasourceKey(event.Datasource.Metadata.Namespace, event.Datasource.Metadata.Name)
+		log.WithField("datasource_name", key).Infof("datasource loaded: %s", key)
+		if event.CA != nil {
+			log.WithField("datasource_name", key).Infof("CA loaded: %s", key)
+		}
+	case EventDeleted:
+		manager.deleteSource(event.Source)
+	case EventReferenceChanged:
+		manager.referenceChanged(event.Reference)
+	default:
+		log.Debugf("unknown datasource event type: %s", event.Type)
+	}
+}
+
+// addProviders registers the providers that report statuses or resolve
+// references.
+func (manager *DatasourceManager) addProviders(providers []DatasourceProvider) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for _, provider := range providers {
+		if reporter, ok := provider.(StatusReporter); ok {
+			manager.reporters = append(manager.reporters, reporter)
+		}
+		if resolver, ok := provider.(ReferenceResolver); ok {
+			manager.resolvers = append(manager.resolvers, resolver)
+		}
+	}
+}
+
+func (manager *DatasourceManager) removeProviders(providers []DatasourceProvider) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	isProvider := func(value interface{}) bool {
+		return slices.ContainsFunc(providers, func(provider DatasourceProvider) bool {
+			return interface{}(provider) == value
+		})
+	}
+	manager.reporters = slices.DeleteFunc(slices.Clone(manager.reporters), func(reporter StatusReporter) bool {
+		return isProvider(reporter)
+	})
+	manager.resolvers = slices.DeleteFunc(slices.Clone(manager.resolvers), func(resolver ReferenceResolver) bool {
+		return isProvider(resolver)
+	})
+}
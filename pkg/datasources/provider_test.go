@@ -0,0 +1,101 @@
+package datasources
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is a provider whose events are sent by the test.
+type fakeProvider struct {
+	name     string
+	startErr error
+	events   chan DatasourceEvent
+	stopped  bool
+}
+
+func newFakeProvider(name string) *fakeProvider {
+	return &fakeProvider{name: name, events: make(chan DatasourceEvent)}
+}
+
+func (p *fakeProvider) Name() string                    { return p.name }
+func (p *fakeProvider) Start(ctx context.Context) error { return p.startErr }
+func (p *fakeProvider) Events() <-chan DatasourceEvent  { return p.events }
+
+func (p *fakeProvider) Stop() {
+	if !p.stopped {
+		p.stopped = true
+		close(p.events)
+	}
+}
+
+func startProviders(t *testing.T, manager *DatasourceManager, providers ...DatasourceProvider) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- manager.Run(ctx, providers...)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
+
+func fakeDatasource(namespace string, name string, url string) *DataSource {
+	return &DataSource{
+		Kind:     "Datasource",
+		Metadata: DatasourceMetadata{Name: name, Namespace: namespace},
+		Spec: DatasourceSpec{Plugin: DatasourcePlugin{
+			Kind: "prometheus",
+			Spec: DatasourcePluginSpec{DirectURL: url},
+		}},
+	}
+}
+
+func TestRun_AppliesProviderEvents(t *testing.T) {
+	manager := NewDatasourceManager()
+	configMaps := newFakeProvider("configmaps")
+	files := newFakeProvider("files")
+	startProviders(t, manager, configMaps, files)
+
+	source := DatasourceSource{Kind: SourceKindConfigMap, Namespace: testNamespace, Name: "datasource"}
+	configMaps.events <- DatasourceEvent{
+		Type:              EventAdded,
+		Source:            source,
+		CreationTimestamp: time.Now(),
+		Datasource:        fakeDatasource(testNamespace, "prometheus", "https://prometheus:9091"),
+	}
+	files.events <- DatasourceEvent{
+		Type:              EventAdded,
+		Source:            DatasourceSource{Kind: "File", Name: "thanos.yaml"},
+		CreationTimestamp: time.Now(),
+		Datasource:        fakeDatasource("", "thanos", "https://thanos:9091"),
+	}
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus") != nil && manager.GetDatasource("thanos") != nil
+	}, waitTimeout, waitInterval)
+
+	configMaps.events <- DatasourceEvent{Type: EventDeleted, Source: source}
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("prometheus") == nil
+	}, waitTimeout, waitInterval)
+	require.NotNil(t, manager.GetDatasource("thanos"))
+}
+
+func TestRun_ProviderStartFailure(t *testing.T) {
+	manager := NewDatasourceManager()
+	started := newFakeProvider("started")
+	failing := newFakeProvider("failing")
+	failing.startErr = errors.New("cannot start")
+
+	err := manager.Run(context.Background(), started, failing)
+	require.Error(t, err)
+	require.True(t, started.stopped)
+}
@@ -0,0 +1,75 @@
+package datasources
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ReferenceResolver is implemented by providers that can read the objects
+// datasources reference, e.g. the Secrets holding their credentials. They
+// report changes to these objects with EventReferenceChanged events.
+type ReferenceResolver interface {
+	// ResolveReference returns the data of the object, false when the
+	// provider does not know it.
+	ResolveReference(reference ObjectReference) (map[string][]byte, bool)
+}
+
+// ResolveReference returns the data of an object referenced by a datasource.
+func (manager *DatasourceManager) ResolveReference(reference ObjectReference) (map[string][]byte, error) {
+	manager.mutex.Lock()
+	resolvers := manager.resolvers
+	manager.mutex.Unlock()
+
+	for _, resolver := range resolvers {
+		if data, ok := resolver.ResolveReference(reference); ok {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found", reference)
+}
+
+// GetSecretKey returns the value of the key of a Secret in the namespace.
+func (manager *DatasourceManager) GetSecretKey(namespace string, selector SecretKeySelector) ([]byte, error) {
+	return manager.getReferenceKey(ObjectReference{Kind: ReferenceKindSecret, Namespace: namespace, Name: selector.Name}, selector.Key)
+}
+
+// GetSecretOrConfigMapKey returns the value of the key of a Secret or a
+// ConfigMap in the namespace.
+func (manager *DatasourceManager) GetSecretOrConfigMapKey(namespace string, selector SecretOrConfigMapKeySelector) ([]byte, error) {
+	if selector.Secret != nil {
+		return manager.GetSecretKey(namespace, *selector.Secret)
+	}
+	if selector.ConfigMap != nil {
+		return manager.getReferenceKey(ObjectReference{Kind: ReferenceKindConfigMap, Namespace: namespace, Name: selector.ConfigMap.Name}, selector.ConfigMap.Key)
+	}
+	return nil, fmt.Errorf("neither a Secret nor a ConfigMap is selected")
+}
+
+func (manager *DatasourceManager) getReferenceKey(reference ObjectReference, key string) ([]byte, error) {
+	data, err := manager.ResolveReference(reference)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := data[key]
+	if !ok {
+		return nil, fmt.Errorf("key '%s' not found in %s", key, reference)
+	}
+	return value, nil
+}
+
+// referenceChanged drops the cached proxies of the datasources referencing
+// the object, so that they are rebuilt with its new data.
+func (manager *DatasourceManager) referenceChanged(reference ObjectReference) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for key, datasource := range *manager.datasourceMap {
+		if datasource == nil || !slices.Contains(datasource.References(), reference) {
+			continue
+		}
+		if (*manager.proxiesMap)[key] != nil {
+			log.WithField("datasource_name", key).Infof("%s changed, rebuilding the proxy of datasource %s", reference, key)
+		}
+		(*manager.proxiesMap)[key] = nil
+	}
+}
@@ -0,0 +1,278 @@
+package datasources
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DatasourceResourceGVR is the Datasource custom resource, an alternative to
+// datasource ConfigMaps with schema validation and status, in its latest
+// version.
+var DatasourceResourceGVR = schema.GroupVersionResource{
+	Group:    "console.openshift.io",
+	Version:  "v1beta1",
+	Resource: "datasources",
+}
+
+// datasourceResourceVersions are the versions of the Datasource resource the
+// plugin watches, latest first. The versions of the CRD are not converted,
+// every version serves every resource, so a single one is watched: the
+// latest one the CRD installed in the cluster has.
+var datasourceResourceVersions = []string{"v1beta1", "v1alpha1"}
+
+const (
+	// ConditionValid is the status condition telling whether the
+	// Datasource resource could be loaded.
+	ConditionValid = "Valid"
+
+	reasonValid       = "Valid"
+	reasonInvalidSpec = "InvalidSpec"
+)
+
+// DatasourceResource is the Datasource custom resource, its spec is the spec
+// of a datasource ConfigMap in the schema of the apiVersion of the resource
+// and its name is the datasource name.
+type DatasourceResource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   json.RawMessage          `json:"spec"`
+	Status DatasourceResourceStatus `json:"status,omitempty"`
+}
+
+type DatasourceResourceStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// datasourceResourceVersion returns the latest version of the Datasource
+// resource the API server serves, and false when it serves none so that
+// clusters without the CRD only watch ConfigMaps.
+func datasourceResourceVersion(client discovery.DiscoveryInterface) (schema.GroupVersionResource, bool) {
+	for _, version := range datasourceResourceVersions {
+		gvr := DatasourceResourceGVR.GroupResource().WithVersion(version)
+		resources, err := client.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+		if err != nil {
+			log.WithError(err).Debugf("%s not available", gvr)
+			continue
+		}
+		for _, resource := range resources.APIResources {
+			if resource.Name == gvr.Resource {
+				return gvr, true
+			}
+		}
+	}
+	log.Infof("%s not available, only watching ConfigMaps", DatasourceResourceGVR.GroupResource())
+	return schema.GroupVersionResource{}, false
+}
+
+func datasourceResourceSource(resource *DatasourceResource) DatasourceSource {
+	return DatasourceSource{
+		Kind:      SourceKindDatasource,
+		Namespace: resource.Namespace,
+		Name:      resource.Name,
+		UID:       resource.UID,
+	}
+}
+
+func toDatasourceResource(obj interface{}) (*unstructured.Unstructured, *DatasourceResource, bool) {
+	object, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, nil, false
+	}
+	var resource DatasourceResource
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &resource); err != nil {
+		log.WithError(err).Errorf("cannot convert Datasource resource: %s/%s", object.GetNamespace(), object.GetName())
+		return nil, nil, false
+	}
+	return object, &resource, true
+}
+
+func (p *KubernetesProvider) datasourceResourceHandler(accept func(namespace string) bool) cache.ResourceEventHandler {
+	load := func(obj interface{}) {
+		if !accept(namespaceOf(obj)) {
+			return
+		}
+		p.loadDatasourceResource(obj)
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: load,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldObject, ok := oldObj.(*unstructured.Unstructured)
+			if !ok {
+				log.Debugf("failed when modified %v", oldObj)
+				return
+			}
+			newObject, ok := newObj.(*unstructured.Unstructured)
+			if !ok {
+				log.Debugf("failed when modified %v", newObj)
+				return
+			}
+			// Status updates, including our own, and periodic resyncs do not
+			// change the datasource.
+			if oldObject.GetGeneration() == newObject.GetGeneration() && oldObject.GetUID() == newObject.GetUID() {
+				return
+			}
+			load(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if _, resource, ok := toDatasourceResource(obj); ok {
+				p.delete(datasourceResourceSource(resource))
+			} else {
+				log.Debugf("failed when deleted %v", obj)
+			}
+		},
+	}
+}
+
+func namespaceOf(obj interface{}) string {
+	if object, ok := obj.(*unstructured.Unstructured); ok {
+		return object.GetNamespace()
+	}
+	return ""
+}
+
+// loadDatasourceResource reports the datasource defined by the resource and
+// records in its status whether it is valid.
+func (p *KubernetesProvider) loadDatasourceResource(obj interface{}) {
+	object, resource, ok := toDatasourceResource(obj)
+	if !ok {
+		log.Debugf("failed when loading %v", obj)
+		return
+	}
+	event := datasourceResourceEvent(resource, p.options.Policy)
+	p.update(event)
+	writeDatasourceResourceStatus(p.ctx, p.dynamicClient, p.resourceGVR, object, resource, event.Err)
+}
+
+func datasourceResourceEvent(resource *DatasourceResource, policy *Policy) DatasourceEvent {
+	event := DatasourceEvent{
+		Source:            datasourceResourceSource(resource),
+		CreationTimestamp: resource.CreationTimestamp.Time,
+	}
+
+	datasource, err := resource.datasource()
+	if err == nil {
+		err = datasource.ValidateWithPolicy(policy)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("invalid datasource in %s", event.Source.Key())
+		event.Err = err
+		return event
+	}
+
+	event.Datasource = datasource
+	return event
+}
+
+// datasource decodes the resource in the schema of its apiVersion and
+// upgrades it to the latest one. The resources written as v1alpha1 are
+// stored unchanged since the versions of the CRD are not converted, their
+// spec is read in the v1alpha1 schema whatever version serves them.
+func (resource *DatasourceResource) datasource() (*DataSource, error) {
+	apiVersion := resource.APIVersion
+	if apiVersion != APIVersionV1Alpha1 && definesV1Alpha1DirectURL(resource.Spec) {
+		apiVersion = APIVersionV1Alpha1
+	}
+
+	definition, err := json.Marshal(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       resource.Kind,
+		"metadata": DatasourceMetadata{
+			Name:      resource.Name,
+			Namespace: resource.Namespace,
+		},
+		"spec": resource.Spec,
+	})
+	if err != nil {
+		return nil, err
+	}
+	datasource, warnings, err := decodeDatasource(definition)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		log.Warnf("Datasource resource %s/%s: %s", resource.Namespace, resource.Name, warning)
+	}
+	return datasource, nil
+}
+
+// definesV1Alpha1DirectURL reports whether the spec holds the URL under its
+// v1alpha1 name only.
+func definesV1Alpha1DirectURL(spec json.RawMessage) bool {
+	var urls struct {
+		Plugin struct {
+			Spec struct {
+				DirectURL         *string `json:"directURL"`
+				V1Alpha1DirectURL *string `json:"direct_url"`
+			} `json:"spec"`
+		} `json:"plugin"`
+	}
+	if err := json.Unmarshal(spec, &urls); err != nil {
+		return false
+	}
+	return urls.Plugin.Spec.DirectURL == nil && urls.Plugin.Spec.V1Alpha1DirectURL != nil
+}
+
+// writeDatasourceResourceStatus records the result of loading the resource
+// in its Valid condition, skipping the write when nothing changed.
+func writeDatasourceResourceStatus(ctx context.Context, client dynamic.Interface, gvr schema.GroupVersionResource, object *unstructured.Unstructured, resource *DatasourceResource, loadErr error) {
+	condition := metav1.Condition{
+		Type:               ConditionValid,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonValid,
+		Message:            "datasource loaded",
+		ObservedGeneration: resource.Generation,
+		LastTransitionTime: metav1.NewTime(time.Now()),
+	}
+	if loadErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reasonInvalidSpec
+		condition.Message = loadErr.Error()
+	}
+
+	status := resource.Status.DeepCopy()
+	if !meta.SetStatusCondition(&status.Conditions, condition) {
+		return
+	}
+
+	statusObject, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		log.WithError(err).Errorf("cannot convert status of Datasource resource: %s/%s", resource.Namespace, resource.Name)
+		return
+	}
+
+	updated := object.DeepCopy()
+	if err := unstructured.SetNestedField(updated.Object, statusObject, "status"); err != nil {
+		log.WithError(err).Errorf("cannot set status of Datasource resource: %s/%s", resource.Namespace, resource.Name)
+		return
+	}
+
+	_, err = client.Resource(gvr).Namespace(resource.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		// a conflicting write means a newer version is on its way to the
+		// informer, its status is written then
+		log.WithError(err).Errorf("cannot update status of Datasource resource: %s/%s", resource.Namespace, resource.Name)
+	}
+}
+
+func (s *DatasourceResourceStatus) DeepCopy() *DatasourceResourceStatus {
+	out := &DatasourceResourceStatus{}
+	for _, condition := range s.Conditions {
+		out.Conditions = append(out.Conditions, *condition.DeepCopy())
+	}
+	return out
+}
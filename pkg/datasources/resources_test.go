@@ -0,0 +1,169 @@
+package datasources
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newDatasourceResource returns a resource with a v1alpha1 spec, the way
+// the resources written as v1alpha1 are served as v1beta1.
+func newDatasourceResource(name string, directURL string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": DatasourceResourceGVR.GroupVersion().String(),
+		"kind":       "Datasource",
+		"metadata": map[string]interface{}{
+			"name":       name,
+			"namespace":  testNamespace,
+			"generation": int64(1),
+		},
+		"spec": map[string]interface{}{
+			"plugin": map[string]interface{}{
+				"kind": "prometheus",
+				"spec": map[string]interface{}{
+					"direct_url": directURL,
+				},
+			},
+		},
+	}}
+}
+
+func newResourceClients(objects ...runtime.Object) (*fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	return newResourceClientsForVersion(DatasourceResourceGVR, objects...)
+}
+
+// newResourceClientsForVersion fakes a cluster whose CRD serves a single
+// version of the Datasource resource.
+func newResourceClientsForVersion(gvr schema.GroupVersionResource, objects ...runtime.Object) (*fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: gvr.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: gvr.Resource, Namespaced: true, Kind: "Datasource"}},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "DatasourceList"}, objects...)
+	return client, dynamicClient
+}
+
+func startResourceWatch(t *testing.T, manager *DatasourceManager, client *fake.Clientset, dynamicClient *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- manager.Run(ctx, NewKubernetesProvider(client, dynamicClient, WatchOptions{Namespaces: []string{testNamespace}}))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
+
+func validCondition(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient, name string) *metav1.Condition {
+	object, err := dynamicClient.Resource(DatasourceResourceGVR).Namespace(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	var resource DatasourceResource
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &resource))
+	return meta.FindStatusCondition(resource.Status.Conditions, ConditionValid)
+}
+
+func TestWatchDatasources_Resources(t *testing.T) {
+	client, dynamicClient := newResourceClients(
+		newDatasourceResource("valid", "https://prometheus:9091"),
+		newDatasourceResource("invalid", "not a url"),
+	)
+	client.CoreV1().ConfigMaps(testNamespace).Create(context.Background(),
+		newDatasourceConfigMap("configmap", datasourceYaml("from-configmap", "https://configmap:9091")), metav1.CreateOptions{})
+	manager := NewDatasourceManager()
+
+	startResourceWatch(t, manager, client, dynamicClient)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("valid") != nil && manager.GetDatasource("from-configmap") != nil
+	}, waitTimeout, waitInterval)
+	require.Nil(t, manager.GetDatasource("invalid"))
+	require.Equal(t, &DatasourceSource{Kind: SourceKindDatasource, Namespace: testNamespace, Name: "valid"}, manager.GetSource("valid"))
+	require.Equal(t, testNamespace, manager.GetDatasource("valid").Metadata.Namespace)
+
+	require.Eventually(t, func() bool {
+		valid := validCondition(t, dynamicClient, "valid")
+		invalid := validCondition(t, dynamicClient, "invalid")
+		return valid != nil && valid.Status == metav1.ConditionTrue &&
+			invalid != nil && invalid.Status == metav1.ConditionFalse && invalid.Reason == reasonInvalidSpec
+	}, waitTimeout, waitInterval)
+
+	require.NoError(t, dynamicClient.Resource(DatasourceResourceGVR).Namespace(testNamespace).Delete(context.Background(), "valid", metav1.DeleteOptions{}))
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("valid") == nil
+	}, waitTimeout, waitInterval)
+}
+
+func TestWatchDatasources_ResourceNotInstalled(t *testing.T) {
+	_, dynamicClient := newResourceClients(newDatasourceResource("valid", "https://prometheus:9091"))
+	client := fake.NewSimpleClientset(newDatasourceConfigMap("configmap", datasourceYaml("from-configmap", "https://configmap:9091")))
+	manager := NewDatasourceManager()
+
+	startResourceWatch(t, manager, client, dynamicClient)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("from-configmap") != nil
+	}, waitTimeout, waitInterval)
+	require.Nil(t, manager.GetDatasource("valid"))
+}
+
+func TestWatchDatasources_ResourceV1Beta1(t *testing.T) {
+	resource := newDatasourceResource("v1beta1", "")
+	require.NoError(t, unstructured.SetNestedMap(resource.Object, map[string]interface{}{
+		"directURL": "https://prometheus:9091",
+		"queryLimits": map[string]interface{}{
+			"maxRange": "7d",
+		},
+		"rateLimits": map[string]interface{}{
+			"user": map[string]interface{}{"requestsPerSecond": int64(5)},
+		},
+	}, "spec", "plugin", "spec"))
+	client, dynamicClient := newResourceClients(resource)
+	manager := NewDatasourceManager()
+
+	startResourceWatch(t, manager, client, dynamicClient)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("v1beta1") != nil
+	}, waitTimeout, waitInterval)
+	spec := manager.GetDatasource("v1beta1").Spec.Plugin.Spec
+	require.Equal(t, "https://prometheus:9091", spec.DirectURL)
+	require.Equal(t, &QueryLimits{MaxRange: "7d"}, spec.QueryLimits)
+	require.Equal(t, &RateLimits{User: &RateLimit{RequestsPerSecond: 5}}, spec.RateLimits)
+}
+
+func TestWatchDatasources_ResourceV1Alpha1(t *testing.T) {
+	gvr := DatasourceResourceGVR.GroupResource().WithVersion("v1alpha1")
+	resource := newDatasourceResource("v1alpha1", "https://prometheus:9091")
+	resource.SetAPIVersion(gvr.GroupVersion().String())
+	client, dynamicClient := newResourceClientsForVersion(gvr, resource)
+	manager := NewDatasourceManager()
+
+	// clusters with the CRD of earlier releases only serve v1alpha1
+	startResourceWatch(t, manager, client, dynamicClient)
+
+	require.Eventually(t, func() bool {
+		return manager.GetDatasource("v1alpha1") != nil
+	}, waitTimeout, waitInterval)
+	require.Equal(t, "https://prometheus:9091", manager.GetDatasource("v1alpha1").Spec.Plugin.Spec.DirectURL)
+	require.Eventually(t, func() bool {
+		object, err := dynamicClient.Resource(gvr).Namespace(testNamespace).Get(context.Background(), "v1alpha1", metav1.GetOptions{})
+		require.NoError(t, err)
+		_, found, err := unstructured.NestedSlice(object.Object, "status", "conditions")
+		require.NoError(t, err)
+		return found
+	}, waitTimeout, waitInterval)
+}
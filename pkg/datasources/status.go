@@ -0,0 +1,105 @@
+package datasources
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Reasons of a LoadStatus.
+const (
+	LoadReasonLoaded            = "Loaded"
+	LoadReasonParseError        = "ParseError"
+	LoadReasonInvalidDatasource = "InvalidDatasource"
+	LoadReasonInvalidCA         = "InvalidCA"
+	LoadReasonUnreachable       = "Unreachable"
+)
+
+// LoadStatus is the outcome of loading a datasource, or of the last attempt
+// to reach it, as written back to its source.
+type LoadStatus struct {
+	Reason  string
+	Message string
+}
+
+// LoadError is a DatasourceEvent error with the reason it is reported under.
+type LoadError struct {
+	Reason string
+	Err    error
+}
+
+func (e *LoadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// StatusReporter is implemented by providers that can tell the owners of a
+// source how its datasource is doing. Sources of other providers are ignored.
+type StatusReporter interface {
+	ReportStatus(source DatasourceSource, status LoadStatus)
+}
+
+// eventStatus is the status of the datasource reported by the event.
+func eventStatus(event DatasourceEvent) LoadStatus {
+	if event.Err != nil {
+		var loadErr *LoadError
+		if errors.As(event.Err, &loadErr) {
+			return LoadStatus{Reason: loadErr.Reason, Message: loadErr.Error()}
+		}
+		return LoadStatus{Reason: LoadReasonInvalidDatasource, Message: event.Err.Error()}
+	}
+	if event.CA != nil && len(*event.CA) > 0 && !x509.NewCertPool().AppendCertsFromPEM([]byte(*event.CA)) {
+		return LoadStatus{Reason: LoadReasonInvalidCA, Message: warningsMessage("no valid PEM certificate found in the CA", event.Warnings)}
+	}
+	return LoadStatus{Reason: LoadReasonLoaded, Message: warningsMessage("datasource loaded", event.Warnings)}
+}
+
+// combinedStatus is the status of an object defining the datasources of the
+// events, the reason of the first failing datasource when any fails.
+func combinedStatus(events []DatasourceEvent) LoadStatus {
+	if len(events) == 1 {
+		return eventStatus(events[0])
+	}
+
+	reason := LoadReasonLoaded
+	messages := []string{}
+	for _, event := range events {
+		status := eventStatus(event)
+		if status.Reason != LoadReasonLoaded && reason == LoadReasonLoaded {
+			reason = status.Reason
+		}
+		if status.Reason != LoadReasonLoaded || len(event.Warnings) > 0 {
+			entry := event.Source.Entry
+			if entry == "" {
+				entry = datasourceKey
+			}
+			messages = append(messages, fmt.Sprintf("%s: %s", entry, status.Message))
+		}
+	}
+
+	if reason == LoadReasonLoaded {
+		messages = append([]string{fmt.Sprintf("%d datasources loaded", len(events))}, messages...)
+	}
+	return LoadStatus{Reason: reason, Message: strings.Join(messages, "; ")}
+}
+
+// ReportStatus tells the provider of the source serving the datasource how
+// it is doing, e.g. when the proxy cannot reach it.
+func (manager *DatasourceManager) ReportStatus(datasourceName string, status LoadStatus) {
+	source := manager.GetSource(datasourceName)
+	if source == nil {
+		return
+	}
+
+	manager.mutex.Lock()
+	reporters := manager.reporters
+	manager.mutex.Unlock()
+
+	for _, reporter := range reporters {
+		reporter.ReportStatus(*source, status)
+	}
+}
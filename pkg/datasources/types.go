@@ -1,12 +1,246 @@
 package datasources
 
+import (
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Kinds of objects datasources are loaded from.
+const (
+	SourceKindConfigMap  = "ConfigMap"
+	SourceKindDatasource = "Datasource"
+	SourceKindFile       = "File"
+)
+
+// Kinds of objects datasources reference.
+const (
+	ReferenceKindSecret    = "Secret"
+	ReferenceKindConfigMap = "ConfigMap"
+)
+
 type DatasourceMetadata struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace,omitempty"`
 }
 
 type DatasourcePluginSpec struct {
-	DirectURL string `json:"direct_url"`
+	DirectURL string `json:"directURL"`
+	// Auth holds the credentials sent to the datasource, none when nil.
+	Auth *DatasourceAuth `json:"auth,omitempty"`
+	// TLS holds the TLS settings of the connections to the datasource.
+	TLS *DatasourceTLS `json:"tls,omitempty"`
+	// AllowedEndpoints replaces the endpoints the proxy serves for the
+	// plugin kind of the datasource.
+	AllowedEndpoints []Endpoint `json:"allowedEndpoints,omitempty"`
+	// NamespaceLabel restricts the queries to the series of the namespace
+	// of the datasource, for datasources shared by several namespaces such
+	// as the cluster Prometheus.
+	NamespaceLabel *NamespaceLabelEnforcement `json:"namespaceLabel,omitempty"`
+	// QueryLimits bound the cost of the range queries sent to the
+	// datasource.
+	QueryLimits *QueryLimits `json:"queryLimits,omitempty"`
+	// RateLimits bound the rate of the requests proxied to the datasource.
+	RateLimits *RateLimits `json:"rateLimits,omitempty"`
+}
+
+// RateLimits bound the requests proxied to a datasource with token buckets,
+// requests beyond them are rejected until the buckets refill.
+type RateLimits struct {
+	// Datasource bounds the requests of every user together.
+	Datasource *RateLimit `json:"datasource,omitempty"`
+	// User bounds the requests of each user, told apart by their bearer
+	// token. The requests without one share a single bucket.
+	User *RateLimit `json:"user,omitempty"`
+}
+
+// RateLimit is a token bucket.
+type RateLimit struct {
+	// RequestsPerSecond is the rate the bucket refills at.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// Burst is the size of the bucket, the number of requests allowed at
+	// once, RequestsPerSecond rounded up when 0.
+	Burst int `json:"burst,omitempty"`
+}
+
+// BurstSize returns the size of the bucket.
+func (limit *RateLimit) BurstSize() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return int(math.Ceil(limit.RequestsPerSecond))
+}
+
+// QueryLimitAction selects what happens to the range queries exceeding the
+// limits.
+type QueryLimitAction string
+
+const (
+	// QueryLimitActionReject rejects the queries exceeding the limits.
+	QueryLimitActionReject QueryLimitAction = "reject"
+	// QueryLimitActionAdjustStep raises the step of the queries with a step
+	// too short or too many points. Queries over a too long range are still
+	// rejected.
+	QueryLimitActionAdjustStep QueryLimitAction = "adjust-step"
+)
+
+// QueryLimits bound the range queries of a Prometheus datasource. The
+// durations are Prometheus durations, e.g. 30s or 7d, unset limits are not
+// enforced.
+type QueryLimits struct {
+	// MaxRange is the longest time range of a query.
+	MaxRange string `json:"maxRange,omitempty"`
+	// MinStep is the shortest step between two points.
+	MinStep string `json:"minStep,omitempty"`
+	// MaxPoints is the highest number of points per series.
+	MaxPoints int64 `json:"maxPoints,omitempty"`
+	// Action is QueryLimitActionReject when empty.
+	Action QueryLimitAction `json:"action,omitempty"`
+}
+
+// MaxRangeDuration returns the longest time range, 0 when unlimited.
+func (limits *QueryLimits) MaxRangeDuration() time.Duration {
+	return parseLimitDuration(limits.MaxRange)
+}
+
+// MinStepDuration returns the shortest step, 0 when unlimited.
+func (limits *QueryLimits) MinStepDuration() time.Duration {
+	return parseLimitDuration(limits.MinStep)
+}
+
+// parseLimitDuration parses a duration validated beforehand.
+func parseLimitDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	duration, err := model.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(duration)
+}
+
+// NamespaceLabelMode selects how queries are restricted to a namespace.
+type NamespaceLabelMode string
+
+const (
+	// NamespaceLabelModeInject sets the namespace matcher on every selector
+	// of the queries.
+	NamespaceLabelModeInject NamespaceLabelMode = "inject"
+	// NamespaceLabelModeVerify rejects the queries with a selector lacking
+	// the namespace matcher.
+	NamespaceLabelModeVerify NamespaceLabelMode = "verify"
+)
+
+// DefaultNamespaceLabel is the label holding the namespace of the series
+// scraped by the cluster Prometheus.
+const DefaultNamespaceLabel = "namespace"
+
+// NamespaceLabelEnforcement restricts the queries of a Prometheus datasource
+// to the series whose label holds the namespace of the datasource. Queries
+// selecting other namespaces are rejected.
+type NamespaceLabelEnforcement struct {
+	// Label is the label holding the namespace, DefaultNamespaceLabel when
+	// empty.
+	Label string `json:"label,omitempty"`
+	// Mode is NamespaceLabelModeInject when empty.
+	Mode NamespaceLabelMode `json:"mode,omitempty"`
+}
+
+// LabelName returns the label holding the namespace.
+func (enforcement *NamespaceLabelEnforcement) LabelName() string {
+	if enforcement.Label == "" {
+		return DefaultNamespaceLabel
+	}
+	return enforcement.Label
+}
+
+// DatasourceTLS configures the TLS connections to the datasource.
+type DatasourceTLS struct {
+	// Cert and KeySecret are the client certificate and key presented to
+	// datasources requiring mutual TLS, both or none must be set.
+	Cert      *SecretOrConfigMapKeySelector `json:"cert,omitempty"`
+	KeySecret *SecretKeySelector            `json:"keySecret,omitempty"`
+	// CA verifies the certificate of the datasource along with the CA of
+	// the datasource ConfigMap, e.g. a ConfigMap OpenShift injects the
+	// service CA into.
+	CA *SecretOrConfigMapKeySelector `json:"ca,omitempty"`
+	// IncludeSystemCAs trusts the system CAs along with the CA of the
+	// datasource, which otherwise replaces them.
+	IncludeSystemCAs bool `json:"includeSystemCAs,omitempty"`
+	// ServerName overrides the name sent for SNI and verified against the
+	// certificate of the datasource.
+	ServerName string `json:"serverName,omitempty"`
+	// InsecureSkipVerify disables the verification of the certificate of
+	// the datasource, the backend can disallow it.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// MinVersion is the minimum TLS version, e.g. VersionTLS13. It cannot
+	// be lower than the minimum version of the backend.
+	MinVersion string `json:"minVersion,omitempty"`
+}
+
+// AuthMode selects the identity queries to the datasource run with.
+type AuthMode string
+
+const (
+	// AuthModeNone sends no credentials at all.
+	AuthModeNone AuthMode = "none"
+	// AuthModeForwardUserToken sends the bearer token of the console user,
+	// for upstreams enforcing the user's permissions like the tenancy port
+	// of Thanos Querier.
+	AuthModeForwardUserToken AuthMode = "forward-user-token"
+	// AuthModeServiceAccount sends the token of the plugin service account.
+	AuthModeServiceAccount AuthMode = "service-account"
+)
+
+// DatasourceAuth selects the credentials sent to the datasource, either by
+// mode or read from Secrets in the namespace of the datasource. Only one
+// kind of credentials may be set. When none is set, no credentials are
+// sent, the bearer token of the console user is only sent in
+// AuthModeForwardUserToken mode.
+type DatasourceAuth struct {
+	Mode AuthMode `json:"mode,omitempty"`
+	// BearerToken is sent in the Authorization header.
+	BearerToken *SecretKeySelector `json:"bearerToken,omitempty"`
+	BasicAuth   *BasicAuth         `json:"basicAuth,omitempty"`
+	// Header sets a header of its own, for upstreams expecting e.g. an API
+	// key.
+	Header *HeaderAuth `json:"header,omitempty"`
+}
+
+// SecretKeySelector selects a key of a Secret in the namespace of the
+// datasource.
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// ConfigMapKeySelector selects a key of a ConfigMap in the namespace of the
+// datasource.
+type ConfigMapKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// SecretOrConfigMapKeySelector selects a key of either a Secret or a
+// ConfigMap, for values that do not need to be kept secret.
+type SecretOrConfigMapKeySelector struct {
+	Secret    *SecretKeySelector    `json:"secret,omitempty"`
+	ConfigMap *ConfigMapKeySelector `json:"configMap,omitempty"`
+}
+
+type BasicAuth struct {
+	Username SecretKeySelector `json:"username"`
+	Password SecretKeySelector `json:"password"`
+}
+
+type HeaderAuth struct {
+	Name  string            `json:"name"`
+	Value SecretKeySelector `json:"value"`
 }
 
 type DatasourcePlugin struct {
@@ -18,8 +252,104 @@ type DatasourceSpec struct {
 	Plugin DatasourcePlugin `json:"plugin"`
 }
 
+// DataSource is a datasource definition of the latest schema, the one every
+// loaded datasource is converted to.
 type DataSource struct {
-	Kind     string             `json:"kind"`
-	Metadata DatasourceMetadata `json:"metadata"`
-	Spec     DatasourceSpec     `json:"spec"`
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind"`
+	Metadata   DatasourceMetadata `json:"metadata"`
+	Spec       DatasourceSpec     `json:"spec"`
+
+	// definedIn is the apiVersion the definition was written in, validation
+	// errors name the fields of that schema
+	definedIn string
+}
+
+// DatasourceSource identifies the object a datasource was loaded from.
+type DatasourceSource struct {
+	Kind      string    `json:"kind,omitempty"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid,omitempty"`
+	// Entry identifies the datasource among the ones defined by the same
+	// object, empty when the object defines a single datasource.
+	Entry string `json:"entry,omitempty"`
+}
+
+// Key returns the "kind/namespace/name" key of the source, followed by
+// "/entry" for the entries of objects defining several datasources.
+func (s DatasourceSource) Key() string {
+	key := strings.ToLower(s.Kind) + "/" + s.Namespace + "/" + s.Name
+	if s.Entry != "" {
+		key += "/" + s.Entry
+	}
+	return key
+}
+
+// Object returns the object the source is an entry of.
+func (s DatasourceSource) Object() DatasourceSource {
+	s.Entry = ""
+	return s
+}
+
+// ObjectReference identifies an object a datasource references, such as the
+// Secret holding its credentials.
+type ObjectReference struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (r ObjectReference) String() string {
+	return r.Kind + " " + r.Namespace + "/" + r.Name
+}
+
+// References returns the objects the datasource reads its settings from, the
+// cached proxy of the datasource is rebuilt when one of them changes.
+func (datasource *DataSource) References() []ObjectReference {
+	references := []ObjectReference{}
+	add := func(kind string, name string) {
+		reference := ObjectReference{Kind: kind, Namespace: datasource.Metadata.Namespace, Name: name}
+		if !slices.Contains(references, reference) {
+			references = append(references, reference)
+		}
+	}
+	addSecret := func(selector *SecretKeySelector) {
+		if selector != nil {
+			add(ReferenceKindSecret, selector.Name)
+		}
+	}
+	addSecretOrConfigMap := func(selector *SecretOrConfigMapKeySelector) {
+		if selector == nil {
+			return
+		}
+		addSecret(selector.Secret)
+		if selector.ConfigMap != nil {
+			add(ReferenceKindConfigMap, selector.ConfigMap.Name)
+		}
+	}
+
+	if auth := datasource.Spec.Plugin.Spec.Auth; auth != nil {
+		addSecret(auth.BearerToken)
+		if auth.BasicAuth != nil {
+			addSecret(&auth.BasicAuth.Username)
+			addSecret(&auth.BasicAuth.Password)
+		}
+		if auth.Header != nil {
+			addSecret(&auth.Header.Value)
+		}
+	}
+	if tls := datasource.Spec.Plugin.Spec.TLS; tls != nil {
+		addSecretOrConfigMap(tls.CA)
+		addSecretOrConfigMap(tls.Cert)
+		addSecret(tls.KeySecret)
+	}
+	return references
+}
+
+// DatasourceStatus describes the object serving a datasource and the objects
+// that declare the same datasource name but lost to it.
+type DatasourceStatus struct {
+	Source    DatasourceSource   `json:"source"`
+	Conflicts []DatasourceSource `json:"conflicts,omitempty"`
 }
@@ -0,0 +1,155 @@
+package datasources
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// URLPolicy restricts the URLs datasources may target, so that whoever can
+// create a datasource cannot use the backend to reach e.g. the cloud metadata
+// endpoint. It is checked when a datasource is loaded and again for every
+// address the proxy connects to, after DNS resolution.
+type URLPolicy struct {
+	// AllowedSchemes are the allowed URL schemes, any of http and https when
+	// empty.
+	AllowedSchemes []string
+	// AllowedHostSuffixes are the allowed host name suffixes, e.g.
+	// .svc.cluster.local.
+	AllowedHostSuffixes []string
+	// AllowedCIDRs are the allowed IP ranges, for hosts given as IPs and for
+	// the addresses host names not matching AllowedHostSuffixes resolve to.
+	AllowedCIDRs []*net.IPNet
+	// DeniedCIDRs are IP ranges that are never reached, even by hosts that
+	// are otherwise allowed.
+	DeniedCIDRs []*net.IPNet
+}
+
+// NewURLPolicy creates a policy from the lists given to the backend, nil when
+// every list is empty.
+func NewURLPolicy(allowedSchemes []string, allowedHostSuffixes []string, allowedCIDRs []string, deniedCIDRs []string) (*URLPolicy, error) {
+	if len(allowedSchemes) == 0 && len(allowedHostSuffixes) == 0 && len(allowedCIDRs) == 0 && len(deniedCIDRs) == 0 {
+		return nil, nil
+	}
+
+	policy := &URLPolicy{}
+	for _, scheme := range allowedSchemes {
+		scheme = strings.ToLower(scheme)
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("unsupported scheme %q: must be http or https", scheme)
+		}
+		policy.AllowedSchemes = append(policy.AllowedSchemes, scheme)
+	}
+	for _, suffix := range allowedHostSuffixes {
+		policy.AllowedHostSuffixes = append(policy.AllowedHostSuffixes, strings.ToLower(suffix))
+	}
+
+	var err error
+	if policy.AllowedCIDRs, err = parseCIDRs(allowedCIDRs); err != nil {
+		return nil, err
+	}
+	if policy.DeniedCIDRs, err = parseCIDRs(deniedCIDRs); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	cidrs := []*net.IPNet{}
+	for _, value := range values {
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	return slices.ContainsFunc(cidrs, func(cidr *net.IPNet) bool {
+		return cidr.Contains(ip)
+	})
+}
+
+// matchesSuffix reports whether the host name ends with an allowed suffix. A
+// suffix without leading dot matches the host with that exact name and its
+// subdomains, not the names merely ending with the same characters.
+func (policy *URLPolicy) matchesSuffix(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return slices.ContainsFunc(policy.AllowedHostSuffixes, func(suffix string) bool {
+		if strings.HasPrefix(suffix, ".") {
+			return strings.HasSuffix(host, suffix)
+		}
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	})
+}
+
+func (policy *URLPolicy) hasAllowRules() bool {
+	return len(policy.AllowedHostSuffixes) > 0 || len(policy.AllowedCIDRs) > 0
+}
+
+// CheckURL checks the scheme and host of a datasource URL.
+func (policy *URLPolicy) CheckURL(target *url.URL) error {
+	if policy == nil {
+		return nil
+	}
+	if len(policy.AllowedSchemes) > 0 && !slices.Contains(policy.AllowedSchemes, strings.ToLower(target.Scheme)) {
+		return fmt.Errorf("scheme %q is not allowed, allowed schemes: %v", target.Scheme, policy.AllowedSchemes)
+	}
+	return policy.CheckHost(target.Hostname())
+}
+
+// CheckHost checks a host before it is resolved. Host names that match no
+// allowed suffix pass when allowed CIDRs are set, the addresses they resolve
+// to are checked by CheckDial.
+func (policy *URLPolicy) CheckHost(host string) error {
+	if policy == nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return policy.CheckDial(host, ip)
+	}
+	if !policy.hasAllowRules() || policy.matchesSuffix(host) || len(policy.AllowedCIDRs) > 0 {
+		return nil
+	}
+	return fmt.Errorf("host %q is not allowed, allowed host suffixes: %v", host, policy.AllowedHostSuffixes)
+}
+
+// CheckDial checks the address the host resolved to, right before connecting
+// to it.
+func (policy *URLPolicy) CheckDial(host string, ip net.IP) error {
+	if policy == nil {
+		return nil
+	}
+	if containsIP(policy.DeniedCIDRs, ip) {
+		return fmt.Errorf("address %s of host %q is denied", ip, host)
+	}
+	if !policy.hasAllowRules() || containsIP(policy.AllowedCIDRs, ip) {
+		return nil
+	}
+	if net.ParseIP(host) == nil && policy.matchesSuffix(host) {
+		return nil
+	}
+	return fmt.Errorf("address %s of host %q is not in the allowed CIDRs %v", ip, host, policy.AllowedCIDRs)
+}
+
+// validateURLPolicy reports the directURL of the datasource as forbidden when
+// the policy does not allow it.
+func (datasource *DataSource) validateURLPolicy(policy *URLPolicy) field.ErrorList {
+	if policy == nil {
+		return nil
+	}
+	target, err := url.Parse(datasource.Spec.Plugin.Spec.DirectURL)
+	if err != nil {
+		return nil
+	}
+	if err := policy.CheckURL(target); err != nil {
+		return field.ErrorList{field.Forbidden(datasource.directURLPath(), err.Error())}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package datasources
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewURLPolicy(t *testing.T) {
+	policy, err := NewURLPolicy(nil, nil, nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	policy, err = NewURLPolicy([]string{"HTTPS"}, []string{".SVC"}, []string{"10.0.0.0/8"}, []string{"169.254.0.0/16", "fe80::/10"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"https"}, policy.AllowedSchemes)
+	require.Equal(t, []string{".svc"}, policy.AllowedHostSuffixes)
+	require.Len(t, policy.AllowedCIDRs, 1)
+	require.Len(t, policy.DeniedCIDRs, 2)
+
+	_, err = NewURLPolicy([]string{"file"}, nil, nil, nil)
+	require.ErrorContains(t, err, "unsupported scheme")
+
+	_, err = NewURLPolicy(nil, nil, nil, []string{"169.254.0.0"})
+	require.ErrorContains(t, err, "invalid CIDR")
+}
+
+func TestURLPolicy_CheckURL(t *testing.T) {
+	policy, err := NewURLPolicy([]string{"https"}, []string{".svc", "prometheus.example.com"}, nil, []string{"169.254.0.0/16"})
+	require.NoError(t, err)
+
+	for target, allowed := range map[string]bool{
+		"https://prometheus.monitoring.svc:9091":  true,
+		"https://PROMETHEUS.MONITORING.SVC.:9091": true,
+		"https://prometheus.example.com":          true,
+		"https://thanos.prometheus.example.com":   true,
+		"https://evilprometheus.example.com":      false,
+		"http://prometheus.monitoring.svc:9091":   false,
+		"https://prometheus.example.org":          false,
+		"https://169.254.169.254/latest":          false,
+		"https://10.0.0.1":                        false,
+	} {
+		parsed, err := url.Parse(target)
+		require.NoError(t, err)
+		if allowed {
+			require.NoError(t, policy.CheckURL(parsed), target)
+		} else {
+			require.Error(t, policy.CheckURL(parsed), target)
+		}
+	}
+
+	var noPolicy *URLPolicy
+	parsed, err := url.Parse("http://169.254.169.254")
+	require.NoError(t, err)
+	require.NoError(t, noPolicy.CheckURL(parsed))
+}
+
+func TestURLPolicy_CheckDial(t *testing.T) {
+	policy, err := NewURLPolicy(nil, []string{".svc"}, []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"})
+	require.NoError(t, err)
+
+	// host names matching no suffix are checked once resolved
+	require.NoError(t, policy.CheckHost("prometheus.example.com"))
+	require.NoError(t, policy.CheckDial("prometheus.example.com", net.ParseIP("10.0.0.1")))
+	require.Error(t, policy.CheckDial("prometheus.example.com", net.ParseIP("192.168.0.1")))
+
+	// allowed suffixes may resolve outside of the allowed CIDRs
+	require.NoError(t, policy.CheckDial("prometheus.monitoring.svc", net.ParseIP("192.168.0.1")))
+
+	// denied CIDRs win over allowed suffixes and CIDRs
+	require.Error(t, policy.CheckDial("prometheus.monitoring.svc", net.ParseIP("10.1.0.1")))
+	require.Error(t, policy.CheckHost("10.1.0.1"))
+	require.NoError(t, policy.CheckHost("10.2.0.1"))
+
+	denyOnly, err := NewURLPolicy(nil, nil, nil, []string{"169.254.0.0/16"})
+	require.NoError(t, err)
+	require.NoError(t, denyOnly.CheckDial("prometheus.example.com", net.ParseIP("192.168.0.1")))
+	require.Error(t, denyOnly.CheckDial("metadata.example.com", net.ParseIP("169.254.169.254")))
+}
+
+func TestConfigMapEvents_URLPolicy(t *testing.T) {
+	policy, err := NewURLPolicy(nil, nil, nil, []string{"169.254.0.0/16"})
+	require.NoError(t, err)
+	configMap := newDatasourceConfigMap("metadata", datasourceYaml("metadata", "http://169.254.169.254"))
+
+	events := configMapEvents(configMap, &Policy{URLs: policy})
+	require.Len(t, events, 1)
+	require.ErrorContains(t, events[0].Err, "is denied")
+
+	events = configMapEvents(configMap, nil)
+	require.Len(t, events, 1)
+	require.NoError(t, events[0].Err)
+}
@@ -0,0 +1,350 @@
+package datasources
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	validator "github.com/asaskevich/govalidator"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/http/httpguts"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	cliflag "k8s.io/component-base/cli/flag"
+	"sigs.k8s.io/yaml"
+)
+
+// DatasourceKind is the only kind of datasource definitions.
+const DatasourceKind = "Datasource"
+
+// PluginKindPrometheus is the kind of Prometheus compatible datasources.
+const PluginKindPrometheus = "prometheus"
+
+// pluginKinds maps the accepted plugin kinds to the kind they stand for,
+// PrometheusDatasource is what the first datasources were documented with.
+var pluginKinds = map[string]string{
+	PluginKindPrometheus:   PluginKindPrometheus,
+	"PrometheusDatasource": PluginKindPrometheus,
+}
+
+// PluginKind returns the plugin kind the value stands for, and false when
+// the kind is unknown.
+func PluginKind(kind string) (string, bool) {
+	pluginKind, ok := pluginKinds[kind]
+	return pluginKind, ok
+}
+
+// decodeDatasource decodes a YAML or JSON datasource definition of any
+// apiVersion into the latest schema. Unknown and
+// duplicate fields do not prevent loading the datasource, they are returned
+// as warnings so that typos are noticed.
+func decodeDatasource(data []byte) (*DataSource, []string, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	datasource, strictErrors, err := decodeVersioned(jsonData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	warnings := []string{}
+	for _, strictError := range strictErrors {
+		warnings = append(warnings, strictError.Error())
+	}
+	return datasource, warnings, nil
+}
+
+// Validate checks that the definition of the datasource is valid, every
+// problem found is reported in the returned error. The policy of the backend
+// is not checked.
+func (datasource *DataSource) Validate() error {
+	return datasource.validate().ToAggregate()
+}
+
+// ValidateWithPolicy validates the datasource and checks that the policy of
+// the backend allows it.
+func (datasource *DataSource) ValidateWithPolicy(policy *Policy) error {
+	errs := datasource.validate()
+	if len(errs) == 0 {
+		errs = datasource.validatePolicy(policy)
+	}
+	return errs.ToAggregate()
+}
+
+// directURLPath names directURL the way the definition of the datasource
+// does.
+func (datasource *DataSource) directURLPath() *field.Path {
+	if datasource.definedIn == APIVersionV1Alpha1 {
+		return field.NewPath("spec", "plugin", "spec", "direct_url")
+	}
+	return field.NewPath("spec", "plugin", "spec", "directURL")
+}
+
+func (datasource *DataSource) validate() field.ErrorList {
+	errs := field.ErrorList{}
+
+	if datasource.Kind != DatasourceKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), datasource.Kind, []string{DatasourceKind}))
+	}
+
+	namePath := field.NewPath("metadata", "name")
+	if datasource.Metadata.Name == "" {
+		errs = append(errs, field.Required(namePath, ""))
+	} else if !validator.IsDNSName(datasource.Metadata.Name) {
+		errs = append(errs, field.Invalid(namePath, datasource.Metadata.Name, "must be a valid DNS name"))
+	}
+
+	pluginPath := field.NewPath("spec", "plugin")
+	pluginKind := datasource.Spec.Plugin.Kind
+	if pluginKind == "" {
+		errs = append(errs, field.Required(pluginPath.Child("kind"), ""))
+	} else if _, ok := PluginKind(pluginKind); !ok {
+		errs = append(errs, field.NotSupported(pluginPath.Child("kind"), pluginKind, knownPluginKinds()))
+	}
+
+	errs = append(errs, validateDirectURL(datasource.directURLPath(), datasource.Spec.Plugin.Spec.DirectURL)...)
+	errs = append(errs, validateAuth(pluginPath.Child("spec", "auth"), datasource.Spec.Plugin.Spec.Auth)...)
+	errs = append(errs, validateTLS(pluginPath.Child("spec", "tls"), datasource.Spec.Plugin.Spec.TLS)...)
+	errs = append(errs, validateEndpoints(pluginPath.Child("spec", "allowedEndpoints"), datasource.Spec.Plugin.Spec.AllowedEndpoints)...)
+	errs = append(errs, validateNamespaceLabel(pluginPath.Child("spec", "namespaceLabel"), datasource.Spec.Plugin.Spec.NamespaceLabel, datasource.Metadata.Namespace)...)
+	errs = append(errs, validateQueryLimits(pluginPath.Child("spec", "queryLimits"), datasource.Spec.Plugin.Spec.QueryLimits)...)
+	errs = append(errs, validateRateLimits(pluginPath.Child("spec", "rateLimits"), datasource.Spec.Plugin.Spec.RateLimits)...)
+
+	return errs
+}
+
+func validateDirectURL(path *field.Path, directURL string) field.ErrorList {
+	if directURL == "" {
+		return field.ErrorList{field.Required(path, "")}
+	}
+
+	parsedURL, err := url.Parse(directURL)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, directURL, err.Error())}
+	}
+
+	errs := field.ErrorList{}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		errs = append(errs, field.Invalid(path, directURL, "scheme must be http or https"))
+	}
+	if parsedURL.Hostname() == "" {
+		errs = append(errs, field.Invalid(path, directURL, "must have a host"))
+	}
+	return errs
+}
+
+var authModes = []AuthMode{AuthModeNone, AuthModeForwardUserToken, AuthModeServiceAccount}
+
+func validateAuth(path *field.Path, auth *DatasourceAuth) field.ErrorList {
+	if auth == nil {
+		return nil
+	}
+
+	errs := field.ErrorList{}
+	set := []string{}
+	if auth.Mode != "" {
+		set = append(set, "mode")
+		if !slices.Contains(authModes, auth.Mode) {
+			errs = append(errs, field.NotSupported(path.Child("mode"), auth.Mode, authModes))
+		}
+	}
+	if auth.BearerToken != nil {
+		set = append(set, "bearerToken")
+		errs = append(errs, validateSecretKeySelector(path.Child("bearerToken"), *auth.BearerToken)...)
+	}
+	if auth.BasicAuth != nil {
+		set = append(set, "basicAuth")
+		errs = append(errs, validateSecretKeySelector(path.Child("basicAuth", "username"), auth.BasicAuth.Username)...)
+		errs = append(errs, validateSecretKeySelector(path.Child("basicAuth", "password"), auth.BasicAuth.Password)...)
+	}
+	if auth.Header != nil {
+		set = append(set, "header")
+		namePath := path.Child("header", "name")
+		if auth.Header.Name == "" {
+			errs = append(errs, field.Required(namePath, ""))
+		} else if !httpguts.ValidHeaderFieldName(auth.Header.Name) {
+			errs = append(errs, field.Invalid(namePath, auth.Header.Name, "must be a valid HTTP header name"))
+		}
+		errs = append(errs, validateSecretKeySelector(path.Child("header", "value"), auth.Header.Value)...)
+	}
+
+	if len(set) > 1 {
+		errs = append(errs, field.Forbidden(path, fmt.Sprintf("only one of mode, bearerToken, basicAuth or header may be set, found %v", set)))
+	}
+	return errs
+}
+
+var namespaceLabelModes = []NamespaceLabelMode{NamespaceLabelModeInject, NamespaceLabelModeVerify}
+
+// labelNameRegexp matches the Prometheus label names.
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validateNamespaceLabel(path *field.Path, enforcement *NamespaceLabelEnforcement, namespace string) field.ErrorList {
+	if enforcement == nil {
+		return nil
+	}
+
+	errs := field.ErrorList{}
+	if namespace == "" {
+		errs = append(errs, field.Required(field.NewPath("metadata", "namespace"), "the namespace queries are restricted to is required"))
+	}
+	if enforcement.Label != "" && !labelNameRegexp.MatchString(enforcement.Label) {
+		errs = append(errs, field.Invalid(path.Child("label"), enforcement.Label, "must be a valid Prometheus label name"))
+	}
+	if enforcement.Mode != "" && !slices.Contains(namespaceLabelModes, enforcement.Mode) {
+		errs = append(errs, field.NotSupported(path.Child("mode"), enforcement.Mode, namespaceLabelModes))
+	}
+	return errs
+}
+
+var queryLimitActions = []QueryLimitAction{QueryLimitActionReject, QueryLimitActionAdjustStep}
+
+func validateQueryLimits(path *field.Path, limits *QueryLimits) field.ErrorList {
+	if limits == nil {
+		return nil
+	}
+
+	errs := field.ErrorList{}
+	errs = append(errs, validateLimitDuration(path.Child("maxRange"), limits.MaxRange)...)
+	errs = append(errs, validateLimitDuration(path.Child("minStep"), limits.MinStep)...)
+	if limits.MaxPoints < 0 || limits.MaxPoints == 1 {
+		errs = append(errs, field.Invalid(path.Child("maxPoints"), limits.MaxPoints, "must be greater than 1"))
+	}
+	if limits.Action != "" && !slices.Contains(queryLimitActions, limits.Action) {
+		errs = append(errs, field.NotSupported(path.Child("action"), limits.Action, queryLimitActions))
+	}
+	return errs
+}
+
+func validateLimitDuration(path *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	duration, err := model.ParseDuration(value)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, value, err.Error())}
+	}
+	if duration <= 0 {
+		return field.ErrorList{field.Invalid(path, value, "must be positive")}
+	}
+	return nil
+}
+
+func validateRateLimits(path *field.Path, limits *RateLimits) field.ErrorList {
+	if limits == nil {
+		return nil
+	}
+
+	errs := field.ErrorList{}
+	errs = append(errs, validateRateLimit(path.Child("datasource"), limits.Datasource)...)
+	errs = append(errs, validateRateLimit(path.Child("user"), limits.User)...)
+	return errs
+}
+
+func validateRateLimit(path *field.Path, limit *RateLimit) field.ErrorList {
+	if limit == nil {
+		return nil
+	}
+
+	errs := field.ErrorList{}
+	if limit.RequestsPerSecond <= 0 || math.IsInf(limit.RequestsPerSecond, 0) || math.IsNaN(limit.RequestsPerSecond) {
+		errs = append(errs, field.Invalid(path.Child("requestsPerSecond"), limit.RequestsPerSecond, "must be positive"))
+	}
+	if limit.Burst < 0 {
+		errs = append(errs, field.Invalid(path.Child("burst"), limit.Burst, "must not be negative"))
+	}
+	return errs
+}
+
+func validateTLS(path *field.Path, tls *DatasourceTLS) field.ErrorList {
+	if tls == nil {
+		return nil
+	}
+
+	errs := field.ErrorList{}
+	if tls.CA != nil {
+		errs = append(errs, validateSecretOrConfigMapKeySelector(path.Child("ca"), *tls.CA)...)
+	}
+	if tls.Cert != nil {
+		errs = append(errs, validateSecretOrConfigMapKeySelector(path.Child("cert"), *tls.Cert)...)
+	}
+	if tls.KeySecret != nil {
+		errs = append(errs, validateSecretKeySelector(path.Child("keySecret"), *tls.KeySecret)...)
+	}
+	if tls.Cert != nil && tls.KeySecret == nil {
+		errs = append(errs, field.Required(path.Child("keySecret"), "the key of the client certificate is required"))
+	}
+	if tls.Cert == nil && tls.KeySecret != nil {
+		errs = append(errs, field.Required(path.Child("cert"), "the client certificate of the key is required"))
+	}
+	if tls.ServerName != "" && !validator.IsDNSName(tls.ServerName) {
+		errs = append(errs, field.Invalid(path.Child("serverName"), tls.ServerName, "must be a valid DNS name"))
+	}
+	if tls.MinVersion != "" {
+		if _, err := ParseTLSVersion(tls.MinVersion); err != nil {
+			errs = append(errs, field.Invalid(path.Child("minVersion"), tls.MinVersion, err.Error()))
+		}
+	}
+	return errs
+}
+
+// ParseTLSVersion parses a TLS version named after the constants of the tls
+// package, e.g. VersionTLS12, like the -tls-min-version flag.
+func ParseTLSVersion(version string) (uint16, error) {
+	return cliflag.TLSVersion(version)
+}
+
+func validateSecretOrConfigMapKeySelector(path *field.Path, selector SecretOrConfigMapKeySelector) field.ErrorList {
+	switch {
+	case selector.Secret != nil && selector.ConfigMap != nil:
+		return field.ErrorList{field.Forbidden(path, "only one of secret or configMap may be set")}
+	case selector.Secret != nil:
+		return validateSecretKeySelector(path.Child("secret"), *selector.Secret)
+	case selector.ConfigMap != nil:
+		return validateKeySelector(path.Child("configMap"), selector.ConfigMap.Name, selector.ConfigMap.Key)
+	default:
+		return field.ErrorList{field.Required(path, "one of secret or configMap is required")}
+	}
+}
+
+func validateSecretKeySelector(path *field.Path, selector SecretKeySelector) field.ErrorList {
+	return validateKeySelector(path, selector.Name, selector.Key)
+}
+
+func validateKeySelector(path *field.Path, name string, key string) field.ErrorList {
+	errs := field.ErrorList{}
+	if name == "" {
+		errs = append(errs, field.Required(path.Child("name"), ""))
+	} else if !validator.IsDNSName(name) {
+		errs = append(errs, field.Invalid(path.Child("name"), name, "must be a valid DNS name"))
+	}
+	if key == "" {
+		errs = append(errs, field.Required(path.Child("key"), ""))
+	} else if messages := validation.IsConfigMapKey(key); len(messages) > 0 {
+		errs = append(errs, field.Invalid(path.Child("key"), key, strings.Join(messages, ", ")))
+	}
+	return errs
+}
+
+func knownPluginKinds() []string {
+	kinds := []string{}
+	for kind := range pluginKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// warningsMessage appends the warnings to a status message.
+func warningsMessage(message string, warnings []string) string {
+	if len(warnings) == 0 {
+		return message
+	}
+	return fmt.Sprintf("%s, warnings: %v", message, warnings)
+}
@@ -0,0 +1,306 @@
+package datasources
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeDatasource_UnknownFields(t *testing.T) {
+	datasource, warnings, err := decodeDatasource([]byte(`kind: "Datasource"
+metadata:
+  name: "prometheus"
+  project: "openshift-config-managed"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      direct_url: "https://prometheus:9091"
+      directUrl: "https://typo:9091"
+`))
+	require.NoError(t, err)
+	require.Equal(t, "https://prometheus:9091", datasource.Spec.Plugin.Spec.DirectURL)
+	require.Len(t, warnings, 2)
+	require.Contains(t, warnings[0], "project")
+	require.Contains(t, warnings[1], "directUrl")
+	require.NoError(t, datasource.Validate())
+}
+
+func TestDecodeDatasource_ParseError(t *testing.T) {
+	_, _, err := decodeDatasource([]byte("kind: ["))
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *DataSource {
+		return &DataSource{
+			Kind:     "Datasource",
+			Metadata: DatasourceMetadata{Name: "prometheus"},
+			Spec: DatasourceSpec{Plugin: DatasourcePlugin{
+				Kind: "prometheus",
+				Spec: DatasourcePluginSpec{DirectURL: "https://prometheus:9091"},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*DataSource)
+		errors []string
+	}{
+		{
+			name:   "valid",
+			modify: func(*DataSource) {},
+		},
+		{
+			name:   "documented plugin kind",
+			modify: func(d *DataSource) { d.Spec.Plugin.Kind = "PrometheusDatasource" },
+		},
+		{
+			name:   "missing kind",
+			modify: func(d *DataSource) { d.Kind = "" },
+			errors: []string{"kind: Unsupported value"},
+		},
+		{
+			name:   "invalid name",
+			modify: func(d *DataSource) { d.Metadata.Name = "my prometheus" },
+			errors: []string{"metadata.name: Invalid value"},
+		},
+		{
+			name:   "unknown plugin kind",
+			modify: func(d *DataSource) { d.Spec.Plugin.Kind = "graphite" },
+			errors: []string{"spec.plugin.kind: Unsupported value"},
+		},
+		{
+			name:   "unsupported scheme",
+			modify: func(d *DataSource) { d.Spec.Plugin.Spec.DirectURL = "ftp://prometheus:9091" },
+			errors: []string{"scheme must be http or https"},
+		},
+		{
+			name:   "relative url",
+			modify: func(d *DataSource) { d.Spec.Plugin.Spec.DirectURL = "/api/v1" },
+			errors: []string{"scheme must be http or https", "must have a host"},
+		},
+		{
+			name: "bearer token",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.Auth = &DatasourceAuth{BearerToken: &SecretKeySelector{Name: "prometheus-token", Key: "token"}}
+			},
+		},
+		{
+			name: "forward user token",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.Auth = &DatasourceAuth{Mode: AuthModeForwardUserToken}
+			},
+		},
+		{
+			name: "unknown auth mode",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.Auth = &DatasourceAuth{Mode: "oauth"}
+			},
+			errors: []string{"spec.plugin.spec.auth.mode: Unsupported value"},
+		},
+		{
+			name: "mode with secret credentials",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.Auth = &DatasourceAuth{
+					Mode:        AuthModeServiceAccount,
+					BearerToken: &SecretKeySelector{Name: "prometheus-token", Key: "token"},
+				}
+			},
+			errors: []string{"spec.plugin.spec.auth: Forbidden: only one of mode, bearerToken, basicAuth or header may be set, found [mode bearerToken]"},
+		},
+		{
+			name: "several credentials",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.Auth = &DatasourceAuth{
+					BearerToken: &SecretKeySelector{Name: "prometheus-token", Key: "token"},
+					BasicAuth: &BasicAuth{
+						Username: SecretKeySelector{Name: "prometheus-basic", Key: "username"},
+						Password: SecretKeySelector{Name: "prometheus-basic", Key: "password"},
+					},
+				}
+			},
+			errors: []string{"spec.plugin.spec.auth: Forbidden: only one of mode, bearerToken"},
+		},
+		{
+			name: "invalid secret references",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.Auth = &DatasourceAuth{BasicAuth: &BasicAuth{
+					Username: SecretKeySelector{Key: "username"},
+					Password: SecretKeySelector{Name: "prometheus-basic", Key: "pass word"},
+				}}
+			},
+			errors: []string{"spec.plugin.spec.auth.basicAuth.username.name: Required", "spec.plugin.spec.auth.basicAuth.password.key: Invalid value"},
+		},
+		{
+			name: "invalid header name",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.Auth = &DatasourceAuth{Header: &HeaderAuth{Name: "X Api Key", Value: SecretKeySelector{Name: "prometheus-key", Key: "key"}}}
+			},
+			errors: []string{"spec.plugin.spec.auth.header.name: Invalid value"},
+		},
+		{
+			name: "client certificate",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.TLS = &DatasourceTLS{
+					Cert:      &SecretOrConfigMapKeySelector{ConfigMap: &ConfigMapKeySelector{Name: "prometheus-client", Key: "tls.crt"}},
+					KeySecret: &SecretKeySelector{Name: "prometheus-client", Key: "tls.key"},
+				}
+			},
+		},
+		{
+			name: "client certificate without key",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.TLS = &DatasourceTLS{
+					Cert: &SecretOrConfigMapKeySelector{Secret: &SecretKeySelector{Name: "prometheus-client", Key: "tls.crt"}},
+				}
+			},
+			errors: []string{"spec.plugin.spec.tls.keySecret: Required"},
+		},
+		{
+			name: "client certificate in a Secret and a ConfigMap",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.TLS = &DatasourceTLS{
+					Cert: &SecretOrConfigMapKeySelector{
+						Secret:    &SecretKeySelector{Name: "prometheus-client", Key: "tls.crt"},
+						ConfigMap: &ConfigMapKeySelector{Name: "prometheus-client", Key: "tls.crt"},
+					},
+					KeySecret: &SecretKeySelector{Name: "prometheus-client", Key: "tls.key"},
+				}
+			},
+			errors: []string{"spec.plugin.spec.tls.cert: Forbidden: only one of secret or configMap"},
+		},
+		{
+			name: "tls options",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.TLS = &DatasourceTLS{ServerName: "prometheus.example.com", MinVersion: "VersionTLS13", InsecureSkipVerify: true}
+			},
+		},
+		{
+			name: "invalid tls options",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.TLS = &DatasourceTLS{ServerName: "prometheus example", MinVersion: "TLS1.3"}
+			},
+			errors: []string{"spec.plugin.spec.tls.serverName: Invalid value", "spec.plugin.spec.tls.minVersion: Invalid value"},
+		},
+		{
+			name: "referenced CA",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.TLS = &DatasourceTLS{
+					CA: &SecretOrConfigMapKeySelector{ConfigMap: &ConfigMapKeySelector{Name: "prometheus-service-ca", Key: "service-ca.crt"}},
+				}
+			},
+		},
+		{
+			name: "CA reference without object",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.TLS = &DatasourceTLS{CA: &SecretOrConfigMapKeySelector{}}
+			},
+			errors: []string{"spec.plugin.spec.tls.ca: Required"},
+		},
+		{
+			name: "allowed endpoints",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.AllowedEndpoints = []Endpoint{{Path: "/api/v1/status/*"}, {Path: "/api/v1/query", Methods: []string{"GET", "POST"}}}
+			},
+		},
+		{
+			name: "invalid allowed endpoints",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.AllowedEndpoints = []Endpoint{{Path: "api/v1/query"}, {Path: "/api/v1/../admin"}, {}, {Path: "/api/v1/query", Methods: []string{"get"}}}
+			},
+			errors: []string{
+				"spec.plugin.spec.allowedEndpoints[0].path: Invalid value",
+				"spec.plugin.spec.allowedEndpoints[1].path: Invalid value",
+				"spec.plugin.spec.allowedEndpoints[2].path: Required",
+				"spec.plugin.spec.allowedEndpoints[3].methods[0]: Unsupported value",
+			},
+		},
+		{
+			name: "namespace label",
+			modify: func(d *DataSource) {
+				d.Metadata.Namespace = "team-a"
+				d.Spec.Plugin.Spec.NamespaceLabel = &NamespaceLabelEnforcement{Label: "kubernetes_namespace", Mode: NamespaceLabelModeVerify}
+			},
+		},
+		{
+			name: "invalid namespace label",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.NamespaceLabel = &NamespaceLabelEnforcement{Label: "kubernetes-namespace", Mode: "replace"}
+			},
+			errors: []string{
+				"metadata.namespace: Required",
+				"spec.plugin.spec.namespaceLabel.label: Invalid value",
+				"spec.plugin.spec.namespaceLabel.mode: Unsupported value",
+			},
+		},
+		{
+			name: "query limits",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.QueryLimits = &QueryLimits{MaxRange: "30d", MinStep: "15s", MaxPoints: 11000, Action: QueryLimitActionAdjustStep}
+			},
+		},
+		{
+			name: "invalid query limits",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.QueryLimits = &QueryLimits{MaxRange: "1 month", MinStep: "0s", MaxPoints: 1, Action: "drop"}
+			},
+			errors: []string{
+				"spec.plugin.spec.queryLimits.maxRange: Invalid value",
+				"spec.plugin.spec.queryLimits.minStep: Invalid value",
+				"spec.plugin.spec.queryLimits.maxPoints: Invalid value",
+				"spec.plugin.spec.queryLimits.action: Unsupported value",
+			},
+		},
+		{
+			name: "rate limits",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.RateLimits = &RateLimits{
+					Datasource: &RateLimit{RequestsPerSecond: 50, Burst: 100},
+					User:       &RateLimit{RequestsPerSecond: 0.5},
+				}
+			},
+		},
+		{
+			name: "invalid rate limits",
+			modify: func(d *DataSource) {
+				d.Spec.Plugin.Spec.RateLimits = &RateLimits{
+					Datasource: &RateLimit{RequestsPerSecond: 0},
+					User:       &RateLimit{RequestsPerSecond: 1, Burst: -1},
+				}
+			},
+			errors: []string{
+				"spec.plugin.spec.rateLimits.datasource.requestsPerSecond: Invalid value",
+				"spec.plugin.spec.rateLimits.user.burst: Invalid value",
+			},
+		},
+		{
+			name: "every error collected",
+			modify: func(d *DataSource) {
+				d.Kind = "ConfigMap"
+				d.Metadata.Name = ""
+				d.Spec.Plugin.Kind = ""
+				d.Spec.Plugin.Spec.DirectURL = ""
+			},
+			errors: []string{"kind:", "metadata.name: Required", "spec.plugin.kind: Required", "spec.plugin.spec.directURL: Required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasource := valid()
+			tt.modify(datasource)
+
+			err := datasource.Validate()
+			if len(tt.errors) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, expected := range tt.errors {
+				require.Contains(t, err.Error(), expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package datasources
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	kjson "sigs.k8s.io/json"
+)
+
+// Datasource definitions carry an apiVersion so that their schema can change
+// without breaking the ConfigMaps already deployed. Every version is
+// upgraded to the latest one, DataSource, when loaded.
+const (
+	DatasourceGroup = "console.openshift.io"
+	// APIVersionV1Alpha1 is the first schema, assumed when a definition has
+	// no apiVersion.
+	APIVersionV1Alpha1 = DatasourceGroup + "/v1alpha1"
+	// APIVersionV1Beta1 renames direct_url to directURL, following the
+	// Kubernetes API conventions the later fields use as well.
+	APIVersionV1Beta1 = DatasourceGroup + "/v1beta1"
+
+	APIVersionLatest = APIVersionV1Beta1
+)
+
+// DataSourceV1Alpha1 is a datasource definition of the v1alpha1 schema.
+type DataSourceV1Alpha1 struct {
+	APIVersion string                 `json:"apiVersion,omitempty"`
+	Kind       string                 `json:"kind"`
+	Metadata   DatasourceMetadata     `json:"metadata"`
+	Spec       DatasourceSpecV1Alpha1 `json:"spec"`
+}
+
+type DatasourceSpecV1Alpha1 struct {
+	Plugin DatasourcePluginV1Alpha1 `json:"plugin"`
+}
+
+type DatasourcePluginV1Alpha1 struct {
+	Kind string                       `json:"kind"`
+	Spec DatasourcePluginSpecV1Alpha1 `json:"spec"`
+}
+
+type DatasourcePluginSpecV1Alpha1 struct {
+	DirectURL string `json:"direct_url"`
+}
+
+// ConvertToLatest upgrades the definition to the latest schema.
+func (in *DataSourceV1Alpha1) ConvertToLatest() *DataSource {
+	return &DataSource{
+		APIVersion: APIVersionLatest,
+		Kind:       in.Kind,
+		Metadata:   in.Metadata,
+		Spec:       in.Spec.ConvertToLatest(),
+	}
+}
+
+func (in *DatasourceSpecV1Alpha1) ConvertToLatest() DatasourceSpec {
+	return DatasourceSpec{
+		Plugin: DatasourcePlugin{
+			Kind: in.Plugin.Kind,
+			Spec: DatasourcePluginSpec{
+				DirectURL: in.Plugin.Spec.DirectURL,
+			},
+		},
+	}
+}
+
+// convertToV1Alpha1 downgrades the datasource for clients of the v1alpha1
+// schema, fields it does not have are dropped.
+func convertToV1Alpha1(in *DataSource) *DataSourceV1Alpha1 {
+	return &DataSourceV1Alpha1{
+		APIVersion: APIVersionV1Alpha1,
+		Kind:       in.Kind,
+		Metadata:   in.Metadata,
+		Spec: DatasourceSpecV1Alpha1{
+			Plugin: DatasourcePluginV1Alpha1{
+				Kind: in.Spec.Plugin.Kind,
+				Spec: DatasourcePluginSpecV1Alpha1{
+					DirectURL: in.Spec.Plugin.Spec.DirectURL,
+				},
+			},
+		},
+	}
+}
+
+// ParseAPIVersion returns the full apiVersion of a version, which may be
+// given without its group, e.g. v1alpha1.
+func ParseAPIVersion(version string) (string, error) {
+	apiVersion := version
+	if !strings.Contains(apiVersion, "/") {
+		apiVersion = DatasourceGroup + "/" + apiVersion
+	}
+	switch apiVersion {
+	case APIVersionV1Alpha1, APIVersionV1Beta1:
+		return apiVersion, nil
+	default:
+		return "", fmt.Errorf("unsupported datasource apiVersion %q: must be %q or %q", version, APIVersionV1Alpha1, APIVersionV1Beta1)
+	}
+}
+
+// ConvertDatasource returns the datasource in the schema of the apiVersion.
+func ConvertDatasource(datasource *DataSource, apiVersion string) (interface{}, error) {
+	apiVersion, err := ParseAPIVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	switch apiVersion {
+	case APIVersionV1Alpha1:
+		return convertToV1Alpha1(datasource), nil
+	default:
+		latest := *datasource
+		latest.APIVersion = APIVersionLatest
+		return &latest, nil
+	}
+}
+
+// decodeVersioned decodes the JSON definition in the schema of its
+// apiVersion and upgrades it to the latest one. The strict errors list the
+// unknown and duplicate fields.
+func decodeVersioned(data []byte) (*DataSource, []error, error) {
+	var versioned struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil, nil, err
+	}
+
+	apiVersion := APIVersionV1Alpha1
+	if versioned.APIVersion != "" {
+		var err error
+		if apiVersion, err = ParseAPIVersion(versioned.APIVersion); err != nil {
+			return nil, nil, err
+		}
+		if apiVersion != versioned.APIVersion {
+			return nil, nil, fmt.Errorf("apiVersion %q must include the %s group", versioned.APIVersion, DatasourceGroup)
+		}
+	}
+
+	switch apiVersion {
+	case APIVersionV1Alpha1:
+		var datasource DataSourceV1Alpha1
+		strictErrors, err := kjson.UnmarshalStrict(data, &datasource)
+		if err != nil {
+			return nil, nil, err
+		}
+		latest := datasource.ConvertToLatest()
+		latest.definedIn = APIVersionV1Alpha1
+		return latest, strictErrors, nil
+	default:
+		var datasource DataSource
+		strictErrors, err := kjson.UnmarshalStrict(data, &datasource)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &datasource, strictErrors, nil
+	}
+}
@@ -0,0 +1,129 @@
+package datasources
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeDatasource_Versions(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		warnings int
+	}{
+		{
+			name: "no apiVersion",
+			yaml: `kind: "Datasource"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      direct_url: "https://prometheus:9091"
+`,
+		},
+		{
+			name: "v1alpha1",
+			yaml: `apiVersion: "console.openshift.io/v1alpha1"
+kind: "Datasource"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      direct_url: "https://prometheus:9091"
+`,
+		},
+		{
+			name: "v1beta1",
+			yaml: `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "https://prometheus:9091"
+`,
+		},
+		{
+			name: "v1beta1 with the v1alpha1 field",
+			yaml: `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "https://prometheus:9091"
+      direct_url: "https://prometheus:9091"
+`,
+			warnings: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasource, warnings, err := decodeDatasource([]byte(tt.yaml))
+			require.NoError(t, err)
+			require.Len(t, warnings, tt.warnings)
+			require.Equal(t, APIVersionLatest, datasource.APIVersion)
+			require.Equal(t, "https://prometheus:9091", datasource.Spec.Plugin.Spec.DirectURL)
+			require.NoError(t, datasource.Validate())
+		})
+	}
+}
+
+func TestDecodeDatasource_UnsupportedVersion(t *testing.T) {
+	for _, apiVersion := range []string{"console.openshift.io/v2", "v1beta1", "monitoring.coreos.com/v1"} {
+		_, _, err := decodeDatasource([]byte(`apiVersion: "` + apiVersion + `"
+kind: "Datasource"
+`))
+		require.Error(t, err, apiVersion)
+	}
+}
+
+func TestValidate_NamesFieldsOfDefinitionVersion(t *testing.T) {
+	datasource, _, err := decodeDatasource([]byte(`kind: "Datasource"
+metadata:
+  name: "prometheus"
+spec:
+  plugin:
+    kind: "prometheus"
+`))
+	require.NoError(t, err)
+	require.ErrorContains(t, datasource.Validate(), "spec.plugin.spec.direct_url: Required")
+}
+
+func TestConvertDatasource(t *testing.T) {
+	datasource := &DataSource{
+		APIVersion: APIVersionLatest,
+		Kind:       DatasourceKind,
+		Metadata:   DatasourceMetadata{Name: "prometheus", Namespace: "monitoring"},
+		Spec: DatasourceSpec{Plugin: DatasourcePlugin{
+			Kind: PluginKindPrometheus,
+			Spec: DatasourcePluginSpec{DirectURL: "https://prometheus:9091"},
+		}},
+	}
+
+	v1alpha1, err := ConvertDatasource(datasource, "v1alpha1")
+	require.NoError(t, err)
+	require.IsType(t, &DataSourceV1Alpha1{}, v1alpha1)
+	require.Equal(t, APIVersionV1Alpha1, v1alpha1.(*DataSourceV1Alpha1).APIVersion)
+
+	// converting back and forth loses nothing the v1alpha1 schema has
+	latest := v1alpha1.(*DataSourceV1Alpha1).ConvertToLatest()
+	require.Equal(t, datasource, latest)
+
+	v1beta1, err := ConvertDatasource(datasource, APIVersionV1Beta1)
+	require.NoError(t, err)
+	require.Equal(t, datasource, v1beta1)
+
+	_, err = ConvertDatasource(datasource, "v1")
+	require.Error(t, err)
+}
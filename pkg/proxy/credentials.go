@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	datasources "github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+// upstreamCredentials returns a function setting the credentials of the
+// datasource on upstream requests. The bearer token the console sends for
+// the user is only passed along in forward-user-token mode, datasources
+// without credentials get no Authorization header at all. Values read from
+// Secrets are read once, the proxy is rebuilt when the Secrets change.
+func upstreamCredentials(datasourceManager *datasources.DatasourceManager, datasource *datasources.DataSource, serviceAccountToken *tokenFile) (func(*http.Request), error) {
+	removeAuthorization := func(r *http.Request) {
+		r.Header.Del("Authorization")
+	}
+	auth := datasource.Spec.Plugin.Spec.Auth
+	if auth == nil {
+		return removeAuthorization, nil
+	}
+	namespace := datasource.Metadata.Namespace
+
+	// Values are trimmed as Secrets created from files often end with a
+	// newline, which is never part of the credentials.
+	secretValue := func(selector datasources.SecretKeySelector) (string, error) {
+		value, err := datasourceManager.GetSecretKey(namespace, selector)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(value)), nil
+	}
+
+	switch {
+	case auth.Mode == datasources.AuthModeNone:
+		return removeAuthorization, nil
+	case auth.Mode == datasources.AuthModeForwardUserToken:
+		// only the bearer token the console sends for the user is passed,
+		// never other kinds of credentials
+		return func(r *http.Request) {
+			if !isBearer(r.Header.Get("Authorization")) {
+				r.Header.Del("Authorization")
+			}
+		}, nil
+	case auth.Mode == datasources.AuthModeServiceAccount:
+		// the token is read on every request so that a rotated token is
+		// used without rebuilding the proxy
+		if _, err := serviceAccountToken.Token(); err != nil {
+			return nil, fmt.Errorf("cannot read the service account token: %w", err)
+		}
+		return func(r *http.Request) {
+			token, err := serviceAccountToken.Token()
+			if err != nil {
+				log.WithError(err).Error("cannot read the service account token")
+				r.Header.Del("Authorization")
+				return
+			}
+			r.Header.Set("Authorization", "Bearer "+token)
+		}, nil
+	case auth.BearerToken != nil:
+		token, err := secretValue(*auth.BearerToken)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}, nil
+	case auth.BasicAuth != nil:
+		username, err := secretValue(auth.BasicAuth.Username)
+		if err != nil {
+			return nil, err
+		}
+		password, err := secretValue(auth.BasicAuth.Password)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) {
+			r.SetBasicAuth(username, password)
+		}, nil
+	case auth.Header != nil:
+		value, err := secretValue(auth.Header.Value)
+		if err != nil {
+			return nil, err
+		}
+		name := auth.Header.Name
+		return func(r *http.Request) {
+			r.Header.Del("Authorization")
+			r.Header.Set(name, value)
+		}, nil
+	}
+	return removeAuthorization, nil
+}
+
+func isBearer(authorization string) bool {
+	const prefix = "Bearer "
+	return len(authorization) > len(prefix) && strings.EqualFold(authorization[:len(prefix)], prefix)
+}
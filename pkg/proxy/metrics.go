@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "console_dashboards_plugin",
+	Name:      "proxy_rate_limited_requests_total",
+	Help:      "Number of requests to a datasource rejected because the rate limit of the datasource or of the user was exceeded, by scope of the exceeded limit.",
+}, []string{"datasource", "namespace", "scope"})
+
+func init() {
+	prometheus.MustRegister(rateLimitedRequests)
+}
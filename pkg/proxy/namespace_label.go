@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+// namespaceEnforcer restricts PromQL queries and series selectors to the
+// series whose label holds the namespace, as prom-label-proxy does.
+type namespaceEnforcer struct {
+	label     string
+	namespace string
+	verify    bool
+}
+
+// enforceNamespaceLabel restricts the queries of the request to the
+// namespace of the datasource when the datasource sets namespaceLabel.
+// Requests to the endpoints whose parameters are not known to be safe are
+// rejected.
+func enforceNamespaceLabel(r *http.Request, datasource *datasources.DataSource) error {
+	enforcement := datasource.Spec.Plugin.Spec.NamespaceLabel
+	if enforcement == nil {
+		return nil
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return newRequestError(http.StatusForbidden, "%s requests are not allowed on a datasource restricted to a namespace", r.Method)
+	}
+
+	enforcer := &namespaceEnforcer{
+		label:     enforcement.LabelName(),
+		namespace: datasource.Metadata.Namespace,
+		verify:    enforcement.Mode == datasources.NamespaceLabelModeVerify,
+	}
+	switch {
+	case r.URL.Path == "/api/v1/query" || r.URL.Path == "/api/v1/query_range":
+		return rewriteParams(r, func(params url.Values) error {
+			return rewriteParam(params, "query", enforcer.enforceQuery)
+		})
+	case isSelectorEndpoint(r.URL.Path):
+		found := false
+		err := rewriteParams(r, func(params url.Values) error {
+			found = found || len(params["match[]"]) > 0
+			return rewriteParam(params, "match[]", enforcer.enforceSelector)
+		})
+		if err != nil {
+			return err
+		}
+		// the series, labels and label values endpoints match every series
+		// when no selector is given
+		if !found {
+			params := r.URL.Query()
+			params.Add("match[]", enforcer.selector(nil))
+			r.URL.RawQuery = params.Encode()
+		}
+		return nil
+	default:
+		return newRequestError(http.StatusForbidden, "%s is not allowed on a datasource restricted to a namespace", r.URL.Path)
+	}
+}
+
+// isSelectorEndpoint reports whether the path is one of the endpoints
+// taking match[] series selectors.
+func isSelectorEndpoint(path string) bool {
+	if path == "/api/v1/series" || path == "/api/v1/labels" {
+		return true
+	}
+	segments := strings.Split(path, "/")
+	return len(segments) == 6 && strings.HasPrefix(path, "/api/v1/label/") && segments[5] == "values"
+}
+
+func rewriteParam(params url.Values, name string, rewrite func(string) (string, error)) error {
+	for i, value := range params[name] {
+		rewritten, err := rewrite(value)
+		if err != nil {
+			return err
+		}
+		params[name][i] = rewritten
+	}
+	return nil
+}
+
+// enforceQuery restricts every selector of the PromQL query.
+func (enforcer *namespaceEnforcer) enforceQuery(query string) (string, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return "", newRequestError(http.StatusBadRequest, "cannot parse query: %v", err)
+	}
+	err = parser.Walk(selectorVisitor(func(selector *parser.VectorSelector) error {
+		matchers, err := enforcer.enforceMatchers(selector.LabelMatchers)
+		selector.LabelMatchers = matchers
+		return err
+	}), expr, nil)
+	if err != nil {
+		return "", err
+	}
+	return expr.String(), nil
+}
+
+// enforceSelector restricts a series selector.
+func (enforcer *namespaceEnforcer) enforceSelector(selector string) (string, error) {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return "", newRequestError(http.StatusBadRequest, "cannot parse selector: %v", err)
+	}
+	matchers, err = enforcer.enforceMatchers(matchers)
+	if err != nil {
+		return "", err
+	}
+	return enforcer.selector(matchers), nil
+}
+
+func (enforcer *namespaceEnforcer) selector(matchers []*labels.Matcher) string {
+	if matchers == nil {
+		matchers = []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, enforcer.label, enforcer.namespace)}
+	}
+	return (&parser.VectorSelector{LabelMatchers: matchers}).String()
+}
+
+// enforceMatchers rejects the matchers on the label that the namespace does
+// not satisfy, as they select the series of other namespaces. In inject
+// mode the matchers on the label are replaced with one selecting the
+// namespace, in verify mode that matcher must already be there.
+func (enforcer *namespaceEnforcer) enforceMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	enforced := []*labels.Matcher{}
+	found := false
+	for _, matcher := range matchers {
+		if matcher.Name != enforcer.label {
+			enforced = append(enforced, matcher)
+			continue
+		}
+		if !matcher.Matches(enforcer.namespace) {
+			return nil, newRequestError(http.StatusForbidden, "matcher %s selects series outside of namespace %q", matcher, enforcer.namespace)
+		}
+		if matcher.Type == labels.MatchEqual {
+			found = true
+		}
+		if enforcer.verify {
+			enforced = append(enforced, matcher)
+		}
+	}
+
+	if enforcer.verify {
+		if !found {
+			return nil, newRequestError(http.StatusForbidden, "every selector must have the matcher %s=%q", enforcer.label, enforcer.namespace)
+		}
+		return enforced, nil
+	}
+	return append(enforced, labels.MustNewMatcher(labels.MatchEqual, enforcer.label, enforcer.namespace)), nil
+}
+
+// selectorVisitor calls the function on every vector selector of the
+// expression, including the ones of range vectors and subqueries.
+type selectorVisitor func(*parser.VectorSelector) error
+
+func (visit selectorVisitor) Visit(node parser.Node, _ []parser.Node) (parser.Visitor, error) {
+	if selector, ok := node.(*parser.VectorSelector); ok {
+		if err := visit(selector); err != nil {
+			return nil, err
+		}
+	}
+	return visit, nil
+}
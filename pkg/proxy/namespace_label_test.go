@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+func TestNamespaceEnforcer_Inject(t *testing.T) {
+	enforcer := &namespaceEnforcer{label: "namespace", namespace: "team-a"}
+
+	tests := []struct {
+		query    string
+		expected string
+		status   int
+	}{
+		{query: "up", expected: `up{namespace="team-a"}`},
+		{query: `sum by (pod) (rate(http_requests_total{job="api"}[5m]))`, expected: `sum by (pod) (rate(http_requests_total{job="api",namespace="team-a"}[5m]))`},
+		{query: `up{namespace="team-a"} / on() group_left max_over_time(up[1h:5m])`, expected: `up{namespace="team-a"} / on () group_left () max_over_time(up{namespace="team-a"}[1h:5m])`},
+		{query: `up{namespace=~"team-.*"}`, expected: `up{namespace="team-a"}`},
+		{query: `vector(1)`, expected: `vector(1)`},
+		{query: `up{namespace="team-b"}`, status: http.StatusForbidden},
+		{query: `up or up{namespace!="team-a"}`, status: http.StatusForbidden},
+		{query: `up{`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			enforced, err := enforcer.enforceQuery(tt.query)
+			if tt.status != 0 {
+				var reqErr *requestError
+				require.ErrorAs(t, err, &reqErr)
+				require.Equal(t, tt.status, reqErr.status)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, enforced)
+		})
+	}
+}
+
+func TestNamespaceEnforcer_Verify(t *testing.T) {
+	enforcer := &namespaceEnforcer{label: "kubernetes_namespace", namespace: "team-a", verify: true}
+
+	enforced, err := enforcer.enforceQuery(`up{kubernetes_namespace="team-a"} + on() absent(down{kubernetes_namespace="team-a",kubernetes_namespace=~"team-.*"})`)
+	require.NoError(t, err)
+	require.Equal(t, `up{kubernetes_namespace="team-a"} + on () absent(down{kubernetes_namespace="team-a",kubernetes_namespace=~"team-.*"})`, enforced)
+
+	_, err = enforcer.enforceQuery(`up{kubernetes_namespace="team-a"} + down`)
+	require.ErrorContains(t, err, `every selector must have the matcher kubernetes_namespace="team-a"`)
+
+	_, err = enforcer.enforceQuery(`up{kubernetes_namespace=~"team-a|team-b"}`)
+	require.Error(t, err)
+
+	selector, err := enforcer.enforceSelector(`{__name__="up",kubernetes_namespace="team-a"}`)
+	require.NoError(t, err)
+	require.Equal(t, `{__name__="up",kubernetes_namespace="team-a"}`, selector)
+}
+
+func TestProxyHandler_NamespaceLabel(t *testing.T) {
+	type upstreamRequest struct {
+		method string
+		path   string
+		query  url.Values
+		form   url.Values
+	}
+	requests := make(chan upstreamRequest, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(body)), r.ContentLength)
+		form, err := url.ParseQuery(string(body))
+		require.NoError(t, err)
+		requests <- upstreamRequest{method: r.Method, path: r.URL.Path, query: r.URL.Query(), form: form}
+	}))
+	defer upstream.Close()
+
+	datasourceManager := datasources.NewDatasourceManager()
+	datasourceManager.SetDatasource("team-a/prometheus", &datasources.DataSource{
+		Metadata: datasources.DatasourceMetadata{Name: "prometheus", Namespace: "team-a"},
+		Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+			Kind: datasources.PluginKindPrometheus,
+			Spec: datasources.DatasourcePluginSpec{
+				DirectURL:      upstream.URL,
+				NamespaceLabel: &datasources.NamespaceLabelEnforcement{},
+				AllowedEndpoints: []datasources.Endpoint{
+					{Path: "/api/v1/query", Methods: []string{http.MethodGet, http.MethodPost}},
+					{Path: "/api/v1/label/*/values"},
+					{Path: "/api/v1/status/config"},
+				},
+			},
+		}},
+	})
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
+
+	serve := func(method string, target string, contentType string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, "/namespaces/team-a/proxy/prometheus"+target, strings.NewReader(body))
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		request = mux.SetURLVars(request, map[string]string{"namespace": "team-a", "datasourceName": "prometheus"})
+		handler(recorder, request)
+		return recorder
+	}
+
+	recorder := serve(http.MethodGet, "/api/v1/query?query=up", "", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, `up{namespace="team-a"}`, (<-requests).query.Get("query"))
+
+	recorder = serve(http.MethodPost, "/api/v1/query?query=down", "application/x-www-form-urlencoded", "query=up&time=1700000000")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	request := <-requests
+	require.Equal(t, `down{namespace="team-a"}`, request.query.Get("query"))
+	require.Equal(t, `up{namespace="team-a"}`, request.form.Get("query"))
+	require.Equal(t, "1700000000", request.form.Get("time"))
+
+	recorder = serve(http.MethodGet, "/api/v1/label/pod/values", "", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, []string{`{namespace="team-a"}`}, (<-requests).query["match[]"])
+
+	recorder = serve(http.MethodPost, "/api/v1/query", "application/x-www-form-urlencoded", `query=up{namespace="team-b"}`)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	recorder = serve(http.MethodPost, "/api/v1/query", "multipart/form-data; boundary=x", "--x--")
+	require.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+
+	recorder = serve(http.MethodGet, "/api/v1/status/config", "", "")
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+	require.Empty(t, requests)
+}
@@ -3,12 +3,14 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	validator "github.com/asaskevich/govalidator"
@@ -41,7 +43,76 @@ func FilterHeaders(r *http.Response) error {
 	return nil
 }
 
-func getProxy(datasourceName string, datasourceManager *datasources.DatasourceManager, tlsMinVersion uint16, tlsCipherSuites []uint16) *httputil.ReverseProxy {
+// Options are the settings shared by the proxies of every datasource.
+type Options struct {
+	// ServiceAccountTokenFile holds the token sent to the datasources of the
+	// service-account auth mode, DefaultServiceAccountTokenFile when empty.
+	// It is re-read when it changes.
+	ServiceAccountTokenFile string
+	// DisallowInsecureSkipVerify refuses to proxy datasources that disable
+	// the verification of the server certificate.
+	DisallowInsecureSkipVerify bool
+	// TrustedCABundleFile holds CAs trusted for every datasource on top of
+	// their own CA, such as the bundle OpenShift injects into ConfigMaps
+	// labelled config.openshift.io/inject-trusted-cabundle. It is re-read
+	// when it changes.
+	TrustedCABundleFile string
+	// URLPolicy, when set, restricts the addresses the proxies connect to.
+	URLPolicy *datasources.URLPolicy
+	// Policy, when set, keeps the datasources it allows without
+	// namespaceLabel from connecting to the addresses of its shared
+	// upstreams.
+	Policy *datasources.Policy
+}
+
+// proxyConfig is what the proxies created by a handler share.
+type proxyConfig struct {
+	tlsMinVersion       uint16
+	tlsCipherSuites     []uint16
+	options             Options
+	serviceAccountToken *tokenFile
+	// caBundle is nil without a trusted CA bundle file
+	caBundle *watchedFile
+	// caBundleGeneration is the generation of the bundle the cached proxies
+	// were built with
+	caBundleGeneration atomic.Int64
+	rateLimiters       *rateLimiters
+}
+
+// trustedCABundle returns the CAs of the trusted CA bundle file, nil when
+// there is none.
+func (config *proxyConfig) trustedCABundle() []byte {
+	if config.caBundle == nil {
+		return nil
+	}
+	bundle, _, err := config.caBundle.Read()
+	if err != nil {
+		log.WithError(err).Errorf("cannot read the trusted CA bundle %s", config.caBundle.path)
+		return nil
+	}
+	return bundle
+}
+
+// resetOnCABundleChange drops the cached proxies once the trusted CA bundle
+// changed, so that they are rebuilt with the new CAs.
+func (config *proxyConfig) resetOnCABundleChange(datasourceManager *datasources.DatasourceManager) {
+	if config.caBundle == nil {
+		return
+	}
+	_, generation, err := config.caBundle.Read()
+	if err != nil {
+		return
+	}
+	if previous := config.caBundleGeneration.Swap(int64(generation)); previous != int64(generation) {
+		log.Info("trusted CA bundle changed, rebuilding the datasource proxies")
+		datasourceManager.ResetProxies()
+	}
+}
+
+func getProxy(datasourceName string, datasourceManager *datasources.DatasourceManager, config *proxyConfig) *httputil.ReverseProxy {
+	tlsMinVersion := config.tlsMinVersion
+	tlsCipherSuites := config.tlsCipherSuites
+
 	existingProxy := datasourceManager.GetProxy(datasourceName)
 
 	if existingProxy != nil {
@@ -64,21 +135,40 @@ func getProxy(datasourceName string, datasourceManager *datasources.DatasourceMa
 		log.Debugf("No datasource-specific CA for '%s', using system CA bundle", datasourceName)
 	}
 
-	var serviceProxyRootCAs *x509.CertPool
+	caRef, err := referencedCA(datasourceManager, datasource)
+	if err != nil {
+		log.WithError(err).Errorf("cannot load the CA of datasource '%s'", datasourceName)
+		return nil
+	}
+	if len(caRef) > 0 {
+		serviceCertPEM = append(append(serviceCertPEM, '\n'), caRef...)
+		log.Debugf("Using referenced CA for '%s'", datasourceName)
+	}
 
-	if len(serviceCertPEM) > 0 {
-		serviceProxyRootCAs = x509.NewCertPool()
-		if !serviceProxyRootCAs.AppendCertsFromPEM(serviceCertPEM) {
-			log.Errorf("Invalid CA certificate for datasource '%s'", datasourceName)
-			return nil
-		}
-		log.Debugf("Using custom CA pool for datasource '%s'", datasourceName)
-	} else {
-		serviceProxyRootCAs = nil
+	includeSystemCAs := datasource.Spec.Plugin.Spec.TLS != nil && datasource.Spec.Plugin.Spec.TLS.IncludeSystemCAs
+	serviceProxyRootCAs, err := rootCAs(serviceCertPEM, includeSystemCAs, config.trustedCABundle())
+	if err != nil {
+		log.WithError(err).Errorf("Invalid CA certificate for datasource '%s'", datasourceName)
+		return nil
+	}
+	if serviceProxyRootCAs == nil {
 		log.Debugf("Using system CA bundle for datasource '%s'", datasourceName)
+	} else {
+		log.Debugf("Using custom CA pool for datasource '%s'", datasourceName)
+	}
+
+	certificates, err := clientCertificates(datasourceManager, datasource)
+	if err != nil {
+		log.WithError(err).Errorf("cannot load the client certificate of datasource '%s'", datasourceName)
+		return nil
 	}
+	if len(certificates) > 0 {
+		log.Debugf("Using client certificate for datasource '%s'", datasourceName)
+	}
+
 	proxyTLSBaseConfig := &tls.Config{
-		RootCAs: serviceProxyRootCAs,
+		RootCAs:      serviceProxyRootCAs,
+		Certificates: certificates,
 	}
 
 	if tlsMinVersion != 0 {
@@ -101,6 +191,11 @@ func getProxy(datasourceName string, datasourceManager *datasources.DatasourceMa
 		log.Debugf("Using default cipher suites for datasource '%s'", datasourceName)
 	}
 
+	if err := applyTLSOptions(proxyTLSBaseConfig, datasource.Spec.Plugin.Spec.TLS, config.options, datasourceName); err != nil {
+		log.WithError(err).Errorf("cannot apply the TLS settings of datasource '%s'", datasourceName)
+		return nil
+	}
+
 	serviceProxyTLSConfig := oscrypto.SecureTLSConfig(proxyTLSBaseConfig)
 
 	const (
@@ -124,6 +219,23 @@ func getProxy(datasourceName string, datasourceManager *datasources.DatasourceMa
 		TLSClientConfig:     serviceProxyTLSConfig,
 		TLSHandshakeTimeout: tlsHandshakeTimeout,
 	}
+	var sharedUpstreams *datasources.Policy
+	if config.options.Policy.GuardsSharedUpstreams(datasource) {
+		sharedUpstreams = config.options.Policy
+	}
+	if config.options.URLPolicy != nil || sharedUpstreams != nil {
+		// The addresses are checked after DNS resolution so that a host
+		// resolving to a denied address later on cannot bypass the policy.
+		// An HTTP proxy would hide the addresses, connections are direct.
+		transport.Proxy = nil
+		transport.DialContext = policyDialContext(dialer, config.options.URLPolicy, sharedUpstreams)
+	}
+
+	setCredentials, err := upstreamCredentials(datasourceManager, datasource, config.serviceAccountToken)
+	if err != nil {
+		log.WithError(err).Errorf("cannot read the credentials of datasource '%s'", datasourceName)
+		return nil
+	}
 
 	targetURL := datasource.Spec.Plugin.Spec.DirectURL
 	proxyURL, err := url.Parse(targetURL)
@@ -131,17 +243,86 @@ func getProxy(datasourceName string, datasourceManager *datasources.DatasourceMa
 	if err != nil {
 		log.WithError(err).Error("cannot parse direct URL", targetURL)
 		return nil
+	} else if err := config.options.URLPolicy.CheckURL(proxyURL); err != nil {
+		log.WithError(err).Errorf("URL of datasource '%s' is not allowed", datasourceName)
+		return nil
 	} else {
 		reverseProxy := httputil.NewSingleHostReverseProxy(proxyURL)
 		reverseProxy.FlushInterval = time.Millisecond * 100
 		reverseProxy.Transport = transport
-		reverseProxy.ModifyResponse = FilterHeaders
+		director := reverseProxy.Director
+		reverseProxy.Director = func(r *http.Request) {
+			director(r)
+			setCredentials(r)
+		}
+		reverseProxy.ModifyResponse = func(r *http.Response) error {
+			datasourceManager.ReportStatus(datasourceName, datasources.LoadStatus{Reason: datasources.LoadReasonLoaded})
+			return FilterHeaders(r)
+		}
+		reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.WithError(err).Errorf("cannot reach datasource '%s'", datasourceName)
+			// a client going away says nothing about the datasource
+			if !errors.Is(err, context.Canceled) {
+				datasourceManager.ReportStatus(datasourceName, datasources.LoadStatus{Reason: datasources.LoadReasonUnreachable, Message: err.Error()})
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		}
 		datasourceManager.SetProxy(datasourceName, reverseProxy)
 		return reverseProxy
 	}
 }
 
-func CreateProxyHandler(datasourceManager *datasources.DatasourceManager, tlsMinVersion uint16, tlsCipherSuites []uint16) func(http.ResponseWriter, *http.Request) {
+// policyDialContext dials with the dialer, refusing to connect to the
+// addresses the policy does not allow and, when sharedUpstreams is set, to the
+// addresses of its shared upstreams.
+func policyDialContext(dialer *net.Dialer, policy *datasources.URLPolicy, sharedUpstreams *datasources.Policy) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := policy.CheckHost(host); err != nil {
+			return nil, err
+		}
+		var upstreamAddresses []datasources.UpstreamAddress
+		if sharedUpstreams != nil {
+			upstreamAddresses = sharedUpstreams.SharedUpstreamAddresses(ctx)
+		}
+
+		policyDialer := *dialer
+		policyDialer.Control = func(_, address string, _ syscall.RawConn) error {
+			ipString, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(ipString)
+			if ip == nil {
+				return fmt.Errorf("cannot parse dialed address %q", address)
+			}
+			if err := policy.CheckDial(host, ip); err != nil {
+				return err
+			}
+			return datasources.CheckSharedUpstreamDial(upstreamAddresses, host, ip, port)
+		}
+		return policyDialer.DialContext(ctx, network, addr)
+	}
+}
+
+func CreateProxyHandler(datasourceManager *datasources.DatasourceManager, tlsMinVersion uint16, tlsCipherSuites []uint16, options Options) func(http.ResponseWriter, *http.Request) {
+	config := &proxyConfig{
+		tlsMinVersion:       tlsMinVersion,
+		tlsCipherSuites:     tlsCipherSuites,
+		options:             options,
+		serviceAccountToken: newTokenFile(options.ServiceAccountTokenFile),
+		rateLimiters:        newRateLimiters(datasourceManager.GetDatasource),
+	}
+	if options.TrustedCABundleFile != "" {
+		config.caBundle = newWatchedFile(options.TrustedCABundleFile)
+		if _, _, err := config.caBundle.Read(); err != nil {
+			log.WithError(err).Errorf("cannot read the trusted CA bundle %s", options.TrustedCABundleFile)
+		}
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		datasourceName := vars["datasourceName"]
@@ -158,14 +339,62 @@ func CreateProxyHandler(datasourceManager *datasources.DatasourceManager, tlsMin
 			return
 		}
 
-		datasourceProxy := getProxy(datasourceName, datasourceManager, tlsMinVersion, tlsCipherSuites)
+		// Requests under /namespaces/{namespace}/proxy/ address the
+		// datasource of that namespace rather than resolving the bare name.
+		datasourceID := datasourceName
+		prefix := fmt.Sprintf("/proxy/%s", datasourceName)
+		if namespace, ok := vars["namespace"]; ok {
+			if !validator.IsDNSName(namespace) {
+				log.Error("invalid datasource namespace")
+				http.Error(w, "invalid datasource namespace", http.StatusBadRequest)
+				return
+			}
+			datasourceID = datasources.DatasourceKey(namespace, datasourceName)
+			prefix = fmt.Sprintf("/namespaces/%s/proxy/%s", namespace, datasourceName)
+		}
+
+		config.resetOnCABundleChange(datasourceManager)
+		datasourceProxy := getProxy(datasourceID, datasourceManager, config)
 
 		if datasourceProxy == nil {
-			log.Errorf("cannot proxy request, invalid datasource proxy: %s", datasourceName)
+			log.Errorf("cannot proxy request, invalid datasource proxy: %s", datasourceID)
+			http.Error(w, "cannot proxy request, invalid datasource proxy", http.StatusNotFound)
+			return
+		}
+
+		datasource := datasourceManager.GetDatasource(datasourceID)
+		if datasource == nil {
 			http.Error(w, "cannot proxy request, invalid datasource proxy", http.StatusNotFound)
 			return
 		}
 
-		http.StripPrefix(fmt.Sprintf("/proxy/%s", datasourceName), http.HandlerFunc(datasourceProxy.ServeHTTP)).ServeHTTP(w, r)
+		http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// only the endpoints of the datasource kind are served, which
+			// keeps e.g. the admin API of Prometheus out of reach
+			if !datasource.AllowsRequest(r.Method, r.URL.Path) {
+				log.Debugf("%s %s is not allowed on datasource '%s'", r.Method, r.URL.Path, datasourceID)
+				http.Error(w, fmt.Sprintf("%s %s is not allowed on this datasource", r.Method, r.URL.Path), http.StatusForbidden)
+				return
+			}
+			if err := enforceNamespaceLabel(r, datasource); err != nil {
+				log.WithError(err).Debugf("rejected query to datasource '%s'", datasourceID)
+				writeRequestError(w, err)
+				return
+			}
+			if err := enforceQueryLimits(r, datasource); err != nil {
+				log.WithError(err).Debugf("rejected query to datasource '%s'", datasourceID)
+				writeRequestError(w, err)
+				return
+			}
+			// only the requests about to be proxied take tokens
+			if scope, delay := config.rateLimiters.reserve(datasource, r); delay > 0 {
+				log.Debugf("%s rate limit of datasource '%s' exceeded", scope, datasourceID)
+				rateLimitedRequests.WithLabelValues(datasource.Metadata.Name, datasource.Metadata.Namespace, scope).Inc()
+				w.Header().Set("Retry-After", retryAfter(delay))
+				http.Error(w, fmt.Sprintf("%s rate limit of the datasource exceeded, retry later", scope), http.StatusTooManyRequests)
+				return
+			}
+			datasourceProxy.ServeHTTP(w, r)
+		})).ServeHTTP(w, r)
 	}
 }
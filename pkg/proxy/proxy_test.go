@@ -1,15 +1,26 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	certutil "k8s.io/client-go/util/cert"
 
 	datasources "github.com/openshift/console-dashboards-plugin/pkg/datasources"
 )
@@ -19,7 +30,7 @@ func TestCreateProxyHandler_TLSConfiguration(t *testing.T) {
 	tlsMinVersion := uint16(tls.VersionTLS13)
 	tlsCipherSuites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
 
-	handler := CreateProxyHandler(datasourceManager, tlsMinVersion, tlsCipherSuites)
+	handler := CreateProxyHandler(datasourceManager, tlsMinVersion, tlsCipherSuites, Options{})
 
 	require.NotNil(t, handler)
 }
@@ -27,7 +38,7 @@ func TestCreateProxyHandler_TLSConfiguration(t *testing.T) {
 func TestCreateProxyHandler_NilTLSConfiguration(t *testing.T) {
 	datasourceManager := datasources.NewDatasourceManager()
 
-	handler := CreateProxyHandler(datasourceManager, 0, nil)
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
 
 	require.NotNil(t, handler)
 }
@@ -35,7 +46,7 @@ func TestCreateProxyHandler_NilTLSConfiguration(t *testing.T) {
 func TestCreateProxyHandler_SystemCADefaults(t *testing.T) {
 	datasourceManager := datasources.NewDatasourceManager()
 
-	handler := CreateProxyHandler(datasourceManager, 0, nil)
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
 	require.NotNil(t, handler)
 }
 
@@ -153,3 +164,477 @@ func TestProxyHandler_TLSCipherSuiteEnforcement(t *testing.T) {
 	_, err = clientMismatch.Get(server.URL + "/health")
 	require.Error(t, err, "Client with non-matching cipher suite should be rejected")
 }
+
+func TestProxyHandler_UnreachableDatasource(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	unreachableURL := server.URL
+	server.Close()
+
+	datasourceManager := datasources.NewDatasourceManager()
+	datasourceManager.SetDatasource("unreachable", &datasources.DataSource{
+		Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+			Kind: datasources.PluginKindPrometheus,
+			Spec: datasources.DatasourcePluginSpec{DirectURL: unreachableURL},
+		}},
+	})
+
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
+	recorder := httptest.NewRecorder()
+	request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/unreachable/api/v1/query", nil), map[string]string{"datasourceName": "unreachable"})
+	handler(recorder, request)
+
+	require.Equal(t, http.StatusBadGateway, recorder.Code)
+}
+
+// watchedDatasource loads the datasource definition from a labelled ConfigMap
+// of the monitoring namespace, watched along with the objects, and returns
+// the client of the cluster and a function querying the datasource through
+// the proxy once it is loaded. The ConfigMap and the datasource are named
+// name.
+func watchedDatasource(t *testing.T, name string, definition string, objects ...runtime.Object) (*fake.Clientset, func() int) {
+	t.Helper()
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "monitoring",
+			Labels:    map[string]string{"console.openshift.io/dashboard-datasource": "true"},
+		},
+		Data: map[string]string{"dashboard-datasource.yaml": definition},
+	}
+	client := fake.NewSimpleClientset(append(objects, configMap)...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	datasourceManager := datasources.NewDatasourceManager()
+	go func() {
+		_ = datasourceManager.WatchDatasources(ctx, client, nil, datasources.WatchOptions{Namespaces: []string{"monitoring"}})
+	}()
+
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
+	query := func() int {
+		recorder := httptest.NewRecorder()
+		request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/"+name+"/api/v1/query", nil), map[string]string{"datasourceName": name})
+		request.Header.Set("Authorization", "Bearer console-user")
+		handler(recorder, request)
+		return recorder.Code
+	}
+
+	require.Eventually(t, func() bool {
+		return datasourceManager.GetDatasource(name) != nil
+	}, 5*time.Second, 50*time.Millisecond)
+	return client, query
+}
+
+func TestProxyHandler_SecretCredentials(t *testing.T) {
+	authorization := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secured-token", Namespace: "monitoring"},
+		Data:       map[string][]byte{"token": []byte("first\n")},
+	}
+	client, query := watchedDatasource(t, "secured", `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "secured"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "`+upstream.URL+`"
+      auth:
+        bearerToken:
+          name: "secured-token"
+          key: "token"
+`, secret)
+
+	require.Equal(t, http.StatusOK, query())
+	require.Equal(t, "Bearer first", <-authorization)
+
+	// the rotated token is used once the Secret changes
+	secret.Data["token"] = []byte("second")
+	secret.ResourceVersion = "2"
+	_, err := client.CoreV1().Secrets("monitoring").Update(context.Background(), secret, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		require.Equal(t, http.StatusOK, query())
+		return <-authorization == "Bearer second"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestProxyHandler_AllowedEndpoints(t *testing.T) {
+	requests := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.URL.Path
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name      string
+		endpoints []datasources.Endpoint
+		method    string
+		path      string
+		expected  int
+	}{
+		{name: "query", method: http.MethodPost, path: "/api/v1/query", expected: http.StatusOK},
+		{name: "admin endpoint", method: http.MethodPost, path: "/api/v1/admin/tsdb/delete_series", expected: http.StatusForbidden},
+		{name: "quit", method: http.MethodPut, path: "/-/quit", expected: http.StatusForbidden},
+		{name: "overridden endpoints", endpoints: []datasources.Endpoint{{Path: "/api/v1/status/config"}}, method: http.MethodGet, path: "/api/v1/status/config", expected: http.StatusOK},
+		{name: "kind endpoints replaced", endpoints: []datasources.Endpoint{{Path: "/api/v1/status/config"}}, method: http.MethodGet, path: "/api/v1/query", expected: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasourceManager := datasources.NewDatasourceManager()
+			datasourceManager.SetDatasource("prometheus", &datasources.DataSource{
+				Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+					Kind: datasources.PluginKindPrometheus,
+					Spec: datasources.DatasourcePluginSpec{DirectURL: upstream.URL, AllowedEndpoints: tt.endpoints},
+				}},
+			})
+
+			handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
+			recorder := httptest.NewRecorder()
+			request := mux.SetURLVars(httptest.NewRequest(tt.method, "/proxy/prometheus"+tt.path, nil), map[string]string{"datasourceName": "prometheus"})
+			handler(recorder, request)
+
+			require.Equal(t, tt.expected, recorder.Code)
+			if tt.expected == http.StatusOK {
+				require.Equal(t, tt.method+" "+tt.path, <-requests)
+			} else {
+				require.Empty(t, requests)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_URLPolicy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	policy, err := datasources.NewURLPolicy(nil, nil, nil, []string{"127.0.0.0/8", "::1/128"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		directURL string
+		policy    *datasources.URLPolicy
+		expected  int
+	}{
+		{name: "no policy", directURL: upstream.URL, expected: http.StatusOK},
+		{name: "denied address", directURL: upstream.URL, policy: policy, expected: http.StatusNotFound},
+		{name: "denied resolved address", directURL: "http://localhost:" + upstreamURL.Port(), policy: policy, expected: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasourceManager := datasources.NewDatasourceManager()
+			datasourceManager.SetDatasource("prometheus", &datasources.DataSource{
+				Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+					Kind: datasources.PluginKindPrometheus,
+					Spec: datasources.DatasourcePluginSpec{DirectURL: tt.directURL},
+				}},
+			})
+
+			handler := CreateProxyHandler(datasourceManager, 0, nil, Options{URLPolicy: tt.policy})
+			recorder := httptest.NewRecorder()
+			request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query", nil), map[string]string{"datasourceName": "prometheus"})
+			handler(recorder, request)
+
+			require.Equal(t, tt.expected, recorder.Code)
+		})
+	}
+}
+
+func TestProxyHandler_SharedUpstreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		namespace      string
+		namespaceLabel *datasources.NamespaceLabelEnforcement
+		upstreams      []string
+		expected       int
+	}{
+		// the datasource targets the upstream by IP, which only the
+		// addresses localhost resolves to tell apart
+		{name: "shared upstream", namespace: "team-a", upstreams: []string{"localhost"}, expected: http.StatusBadGateway},
+		{name: "shared upstream port", namespace: "team-a", upstreams: []string{"localhost:" + upstreamURL.Port()}, expected: http.StatusBadGateway},
+		{name: "other port", namespace: "team-a", upstreams: []string{"localhost:1"}, expected: http.StatusOK},
+		{name: "namespace label", namespace: "team-a", namespaceLabel: &datasources.NamespaceLabelEnforcement{}, upstreams: []string{"localhost"}, expected: http.StatusOK},
+		{name: "default namespace", namespace: datasources.DefaultNamespace, upstreams: []string{"localhost"}, expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasourceManager := datasources.NewDatasourceManager()
+			datasourceManager.SetDatasource("prometheus", &datasources.DataSource{
+				Metadata: datasources.DatasourceMetadata{Name: "prometheus", Namespace: tt.namespace},
+				Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+					Kind: datasources.PluginKindPrometheus,
+					Spec: datasources.DatasourcePluginSpec{DirectURL: upstream.URL, NamespaceLabel: tt.namespaceLabel},
+				}},
+			})
+
+			handler := CreateProxyHandler(datasourceManager, 0, nil, Options{Policy: &datasources.Policy{NamespaceLabelUpstreams: tt.upstreams}})
+			recorder := httptest.NewRecorder()
+			request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query", nil), map[string]string{"datasourceName": "prometheus"})
+			handler(recorder, request)
+
+			require.Equal(t, tt.expected, recorder.Code)
+		})
+	}
+}
+
+func TestProxyHandler_AuthModes(t *testing.T) {
+	tokenFile := t.TempDir() + "/token"
+	require.NoError(t, os.WriteFile(tokenFile, []byte("plugin-token\n"), 0600))
+
+	authorization := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		noAuth   bool
+		mode     datasources.AuthMode
+		incoming string
+		expected string
+	}{
+		{noAuth: true, incoming: "Bearer console-user", expected: ""},
+		{mode: "", incoming: "Basic dXNlcjpwYXNz", expected: ""},
+		{mode: "", incoming: "Bearer console-user", expected: ""},
+		{mode: datasources.AuthModeNone, incoming: "Bearer console-user", expected: ""},
+		{mode: datasources.AuthModeForwardUserToken, incoming: "Bearer console-user", expected: "Bearer console-user"},
+		{mode: datasources.AuthModeForwardUserToken, incoming: "Basic dXNlcjpwYXNz", expected: ""},
+		{mode: datasources.AuthModeServiceAccount, incoming: "Bearer console-user", expected: "Bearer plugin-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode)+" "+tt.incoming, func(t *testing.T) {
+			auth := &datasources.DatasourceAuth{Mode: tt.mode}
+			if tt.noAuth {
+				auth = nil
+			}
+			datasourceManager := datasources.NewDatasourceManager()
+			datasourceManager.SetDatasource("prometheus", &datasources.DataSource{
+				Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+					Kind: datasources.PluginKindPrometheus,
+					Spec: datasources.DatasourcePluginSpec{DirectURL: upstream.URL, Auth: auth},
+				}},
+			})
+
+			handler := CreateProxyHandler(datasourceManager, 0, nil, Options{ServiceAccountTokenFile: tokenFile})
+			recorder := httptest.NewRecorder()
+			request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query", nil), map[string]string{"datasourceName": "prometheus"})
+			request.Header.Set("Authorization", tt.incoming)
+			handler(recorder, request)
+
+			require.Equal(t, http.StatusOK, recorder.Code)
+			require.Equal(t, tt.expected, <-authorization)
+		})
+	}
+}
+
+func TestProxyHandler_ClientCertificate(t *testing.T) {
+	clientCert, clientKey, err := certutil.GenerateSelfSignedCertKey("dashboards-plugin", nil, nil)
+	require.NoError(t, err)
+	clientCertBlock, _ := pem.Decode(clientCert)
+
+	upstream, caFile := startTLSServer(t, &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], clientCertBlock.Bytes) {
+				return errors.New("unexpected client certificate")
+			}
+			return nil
+		},
+	})
+	defer upstream.Close()
+	ca, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+
+	client, query := watchedDatasource(t, "mtls", `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "mtls"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "`+upstream.URL+`"
+      tls:
+        ca:
+          configMap:
+            name: "mtls-ca"
+            key: "ca.crt"
+        cert:
+          secret:
+            name: "mtls-client"
+            key: "tls.crt"
+        keySecret:
+          name: "mtls-client"
+          key: "tls.key"
+`, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "mtls-ca", Namespace: "monitoring"},
+		Data:       map[string]string{"ca.crt": string(ca)},
+	})
+
+	// without the Secret there is no proxy
+	require.Equal(t, http.StatusNotFound, query())
+
+	// the proxy is rebuilt once the Secret shows up
+	_, err = client.CoreV1().Secrets("monitoring").Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mtls-client", Namespace: "monitoring"},
+		Data:       map[string][]byte{"tls.crt": clientCert, "tls.key": clientKey},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return query() == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestProxyHandler_TLSOptions(t *testing.T) {
+	upstream, caFile := startTLSServer(t, &tls.Config{})
+	defer upstream.Close()
+	ca, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+	caString := string(ca)
+
+	tests := []struct {
+		name     string
+		tls      *datasources.DatasourceTLS
+		ca       *string
+		options  Options
+		expected int
+	}{
+		{
+			name:     "verified",
+			ca:       &caString,
+			expected: http.StatusOK,
+		},
+		{
+			name:     "server name of the certificate",
+			tls:      &datasources.DatasourceTLS{ServerName: "example.com"},
+			ca:       &caString,
+			expected: http.StatusOK,
+		},
+		{
+			name:     "server name not in the certificate",
+			tls:      &datasources.DatasourceTLS{ServerName: "prometheus.example.org"},
+			ca:       &caString,
+			expected: http.StatusBadGateway,
+		},
+		{
+			name:     "unknown CA",
+			expected: http.StatusBadGateway,
+		},
+		{
+			name:     "insecure skip verify",
+			tls:      &datasources.DatasourceTLS{InsecureSkipVerify: true},
+			expected: http.StatusOK,
+		},
+		{
+			name:     "insecure skip verify disallowed",
+			tls:      &datasources.DatasourceTLS{InsecureSkipVerify: true},
+			options:  Options{DisallowInsecureSkipVerify: true},
+			expected: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datasourceManager := datasources.NewDatasourceManager()
+			datasourceManager.SetDatasource("prometheus", &datasources.DataSource{
+				Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+					Kind: datasources.PluginKindPrometheus,
+					Spec: datasources.DatasourcePluginSpec{DirectURL: upstream.URL, TLS: tt.tls},
+				}},
+			})
+			datasourceManager.SetCA("prometheus", tt.ca)
+
+			handler := CreateProxyHandler(datasourceManager, 0, nil, tt.options)
+			recorder := httptest.NewRecorder()
+			request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query", nil), map[string]string{"datasourceName": "prometheus"})
+			handler(recorder, request)
+
+			require.Equal(t, tt.expected, recorder.Code)
+		})
+	}
+}
+
+func TestApplyTLSOptions_MinVersion(t *testing.T) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	require.NoError(t, applyTLSOptions(config, &datasources.DatasourceTLS{MinVersion: "VersionTLS13"}, Options{}, "prometheus"))
+	require.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+
+	// the minimum version of the backend cannot be lowered
+	config = &tls.Config{MinVersion: tls.VersionTLS12}
+	require.NoError(t, applyTLSOptions(config, &datasources.DatasourceTLS{MinVersion: "VersionTLS10"}, Options{}, "prometheus"))
+	require.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+}
+
+func TestProxyHandler_ReferencedCA(t *testing.T) {
+	upstream, caFile := startTLSServer(t, &tls.Config{})
+	defer upstream.Close()
+	ca, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+
+	client, query := watchedDatasource(t, "service-ca", `apiVersion: "console.openshift.io/v1beta1"
+kind: "Datasource"
+metadata:
+  name: "service-ca"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      directURL: "`+upstream.URL+`"
+      tls:
+        ca:
+          configMap:
+            name: "prometheus-service-ca"
+            key: "service-ca.crt"
+`)
+
+	require.Equal(t, http.StatusNotFound, query())
+
+	// the service CA operator injects the CA
+	caConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "prometheus-service-ca",
+			Namespace:   "monitoring",
+			Annotations: map[string]string{"service.beta.openshift.io/inject-cabundle": "true"},
+		},
+		Data: map[string]string{"service-ca.crt": string(ca)},
+	}
+	_, err = client.CoreV1().ConfigMaps("monitoring").Create(context.Background(), caConfigMap, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return query() == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// a rotated CA replaces the previous one
+	rotatedCA, _, err := certutil.GenerateSelfSignedCertKey("rotated-service-ca", nil, nil)
+	require.NoError(t, err)
+	caConfigMap.Data["service-ca.crt"] = string(rotatedCA)
+	caConfigMap.ResourceVersion = "2"
+	_, err = client.CoreV1().ConfigMaps("monitoring").Update(context.Background(), caConfigMap, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return query() == http.StatusBadGateway
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+// enforceQueryLimits checks the range queries of the request against the
+// limits of the datasource, raising their step when the datasource allows
+// it. Queries beyond the limits are rejected as unprocessable.
+func enforceQueryLimits(r *http.Request, datasource *datasources.DataSource) error {
+	limits := datasource.Spec.Plugin.Spec.QueryLimits
+	if limits == nil || r.URL.Path != "/api/v1/query_range" {
+		return nil
+	}
+
+	params, err := effectiveParams(r)
+	if err != nil {
+		return err
+	}
+	start, err := parsePrometheusTime(params.Get("start"))
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, "invalid parameter start: %v", err)
+	}
+	end, err := parsePrometheusTime(params.Get("end"))
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, "invalid parameter end: %v", err)
+	}
+	step, err := parsePrometheusDuration(params.Get("step"))
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, "invalid parameter step: %v", err)
+	}
+	queryRange := end.Sub(start)
+	if queryRange < 0 || step <= 0 {
+		// rejected by Prometheus itself
+		return nil
+	}
+
+	if maxRange := limits.MaxRangeDuration(); maxRange > 0 && queryRange > maxRange {
+		return newRequestError(http.StatusUnprocessableEntity, "query range %s exceeds the maximum of %s", model.Duration(queryRange), limits.MaxRange)
+	}
+
+	adjust := limits.Action == datasources.QueryLimitActionAdjustStep
+	requested := step
+	minStep := limits.MinStepDuration()
+	if minStep > 0 && step < minStep {
+		if !adjust {
+			return newRequestError(http.StatusUnprocessableEntity, "query step %s is below the minimum of %s", step, limits.MinStep)
+		}
+		step = minStep
+	}
+	if limits.MaxPoints > 0 {
+		if points := int64(queryRange/step) + 1; points > limits.MaxPoints {
+			if !adjust {
+				return newRequestError(http.StatusUnprocessableEntity, "query would return %d points per series, more than the maximum of %d, raise the step", points, limits.MaxPoints)
+			}
+			step = pointsStep(queryRange, limits.MaxPoints)
+		}
+	}
+	if step == requested {
+		return nil
+	}
+
+	log.Debugf("raising the step of query to datasource '%s' from %s to %s", datasource.Metadata.Name, requested, step)
+	formatted := strconv.FormatFloat(step.Seconds(), 'f', -1, 64)
+	return rewriteParams(r, func(params url.Values) error {
+		if params.Has("step") {
+			params.Set("step", formatted)
+		}
+		return nil
+	})
+}
+
+// pointsStep returns the shortest step, in whole milliseconds, returning at
+// most the points over the range.
+func pointsStep(queryRange time.Duration, points int64) time.Duration {
+	step := (queryRange + time.Duration(points-2)) / time.Duration(points-1)
+	return (step + time.Millisecond - 1).Truncate(time.Millisecond)
+}
+
+// effectiveParams returns the parameters of the request the way Prometheus
+// reads them, the ones of the form encoded body first.
+func effectiveParams(r *http.Request) (url.Values, error) {
+	params := r.URL.Query()
+	form, ok, err := postForm(r)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		for name, values := range form {
+			params[name] = append(values, params[name]...)
+		}
+	}
+	return params, nil
+}
+
+// parsePrometheusTime parses a timestamp as the Prometheus HTTP API does,
+// either in seconds since the epoch or in RFC 3339.
+func parsePrometheusTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		fraction = math.Round(fraction*1000) / 1000
+		return time.Unix(int64(whole), int64(fraction*float64(time.Second))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", value)
+}
+
+// parsePrometheusDuration parses a duration as the Prometheus HTTP API does,
+// either in seconds or as a Prometheus duration, e.g. 5m.
+func parsePrometheusDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		duration := seconds * float64(time.Second)
+		if duration > float64(math.MaxInt64) || duration < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration, it overflows int64", value)
+		}
+		return time.Duration(duration), nil
+	}
+	if duration, err := model.ParseDuration(value); err == nil {
+		return time.Duration(duration), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", value)
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+func TestEnforceQueryLimits(t *testing.T) {
+	limited := func(action datasources.QueryLimitAction) *datasources.DataSource {
+		return &datasources.DataSource{Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+			Kind: datasources.PluginKindPrometheus,
+			Spec: datasources.DatasourcePluginSpec{QueryLimits: &datasources.QueryLimits{
+				MaxRange:  "7d",
+				MinStep:   "30s",
+				MaxPoints: 1001,
+				Action:    action,
+			}},
+		}}}
+	}
+	const hour = "start=1700000000&end=1700003600"
+
+	tests := []struct {
+		name     string
+		action   datasources.QueryLimitAction
+		path     string
+		params   string
+		status   int
+		expected string
+	}{
+		{name: "within the limits", path: "/api/v1/query_range", params: hour + "&step=60", expected: "60"},
+		{name: "instant query", path: "/api/v1/query", params: "query=up&step=1", expected: "1"},
+		{name: "range too long", path: "/api/v1/query_range", params: "start=2023-01-01T00:00:00Z&end=2023-01-09T00:00:00Z&step=1h", status: http.StatusUnprocessableEntity},
+		{name: "range too long with adjust-step", action: datasources.QueryLimitActionAdjustStep, path: "/api/v1/query_range", params: "start=2023-01-01T00:00:00Z&end=2023-01-09T00:00:00Z&step=1h", status: http.StatusUnprocessableEntity},
+		{name: "step too short", path: "/api/v1/query_range", params: hour + "&step=15s", status: http.StatusUnprocessableEntity},
+		{name: "step raised to the minimum", action: datasources.QueryLimitActionAdjustStep, path: "/api/v1/query_range", params: hour + "&step=15s", expected: "30"},
+		{name: "too many points", path: "/api/v1/query_range", params: "start=0&end=86400&step=60", status: http.StatusUnprocessableEntity},
+		{name: "step raised to the maximum points", action: datasources.QueryLimitActionAdjustStep, path: "/api/v1/query_range", params: "start=0&end=86400&step=60", expected: "86.4"},
+		{name: "invalid step", path: "/api/v1/query_range", params: hour + "&step=fast", status: http.StatusBadRequest},
+		{name: "missing start", path: "/api/v1/query_range", params: "end=1700003600&step=60", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.path+"?"+tt.params, nil)
+			err := enforceQueryLimits(request, limited(tt.action))
+			if tt.status != 0 {
+				var reqErr *requestError
+				require.ErrorAs(t, err, &reqErr)
+				require.Equal(t, tt.status, reqErr.status)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, request.URL.Query().Get("step"))
+		})
+	}
+}
+
+func TestEnforceQueryLimits_PostForm(t *testing.T) {
+	datasource := &datasources.DataSource{Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+		Kind: datasources.PluginKindPrometheus,
+		Spec: datasources.DatasourcePluginSpec{QueryLimits: &datasources.QueryLimits{MinStep: "1m", Action: datasources.QueryLimitActionAdjustStep}},
+	}}}
+
+	// the parameters of the body win over the ones of the URL
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/query_range?step=120", strings.NewReader("query=up&start=0&end=3600&step=10"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	require.NoError(t, enforceQueryLimits(request, datasource))
+
+	body, err := io.ReadAll(request.Body)
+	require.NoError(t, err)
+	require.Equal(t, "end=3600&query=up&start=0&step=60", string(body))
+	require.Equal(t, int64(len(body)), request.ContentLength)
+	require.Equal(t, "60", request.URL.Query().Get("step"))
+}
+
+func TestPointsStep(t *testing.T) {
+	require.Equal(t, 86400*time.Millisecond, pointsStep(24*time.Hour, 1001))
+	require.Equal(t, 3*time.Millisecond, pointsStep(5*time.Millisecond, 3))
+	require.Equal(t, time.Duration(0), pointsStep(0, 11))
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+// Scopes of the rate limits, as exported in the metrics.
+const (
+	rateLimitScopeDatasource = "datasource"
+	rateLimitScopeUser       = "user"
+)
+
+// Bounds of the buckets kept in memory. Every limiterSweepInterval, the
+// buckets of the datasources that are gone are dropped, along with the user
+// buckets that are full, a full bucket being no different from a new one, or
+// unused for userLimiterIdleTimeout. A datasource keeps at most
+// maxUserLimiters user buckets, the least recently used one is dropped to
+// make room for a new one.
+const (
+	limiterSweepInterval   = time.Minute
+	userLimiterIdleTimeout = 10 * time.Minute
+	maxUserLimiters        = 1000
+)
+
+// rateLimiters holds the token buckets of the datasources setting rate
+// limits, keyed by the datasource key of their namespace and name so that
+// the bare name and namespaced routes share them.
+type rateLimiters struct {
+	mutex       sync.Mutex
+	datasources map[string]*datasourceLimiters
+	// lookup returns the datasource served under the datasource key, nil
+	// once it is deleted
+	lookup    func(datasourceKey string) *datasources.DataSource
+	lastSweep time.Time
+}
+
+// datasourceLimiters are the buckets of a datasource, rebuilt when its
+// limits change.
+type datasourceLimiters struct {
+	limits     datasources.RateLimits
+	datasource *rate.Limiter
+	users      map[string]*userLimiter
+}
+
+// userLimiter is the bucket of a user along with the time it was last used.
+type userLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func newRateLimiters(lookup func(datasourceKey string) *datasources.DataSource) *rateLimiters {
+	return &rateLimiters{
+		datasources: map[string]*datasourceLimiters{},
+		lookup:      lookup,
+		lastSweep:   time.Now(),
+	}
+}
+
+func newLimiter(limit *datasources.RateLimit) *rate.Limiter {
+	if limit == nil {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), limit.BurstSize())
+}
+
+// reserve takes a token from the buckets of the datasource and of the user
+// of the request. When a bucket is empty, nothing is taken and the scope of
+// the empty bucket is returned along with the time until it refills.
+func (limiters *rateLimiters) reserve(datasource *datasources.DataSource, r *http.Request) (string, time.Duration) {
+	limits := datasource.Spec.Plugin.Spec.RateLimits
+	if limits == nil || (limits.Datasource == nil && limits.User == nil) {
+		return "", 0
+	}
+
+	now := time.Now()
+	datasourceKey := datasources.DatasourceKey(datasource.Metadata.Namespace, datasource.Metadata.Name)
+	datasourceLimiter, userLimiter := limiters.get(datasourceKey, limits, userKey(r), now)
+	var userReservation *rate.Reservation
+	if userLimiter != nil {
+		userReservation = userLimiter.ReserveN(now, 1)
+		if delay := userReservation.DelayFrom(now); delay > 0 {
+			userReservation.CancelAt(now)
+			return rateLimitScopeUser, delay
+		}
+	}
+	if datasourceLimiter != nil {
+		reservation := datasourceLimiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			if userReservation != nil {
+				userReservation.CancelAt(now)
+			}
+			return rateLimitScopeDatasource, delay
+		}
+	}
+	return "", 0
+}
+
+// get returns the buckets of the datasource and of the user, nil for the
+// scopes without limits.
+func (limiters *rateLimiters) get(datasourceKey string, limits *datasources.RateLimits, user string, now time.Time) (*rate.Limiter, *rate.Limiter) {
+	limiters.mutex.Lock()
+	defer limiters.mutex.Unlock()
+
+	if now.Sub(limiters.lastSweep) >= limiterSweepInterval {
+		limiters.sweepLocked(now)
+	}
+
+	entry, ok := limiters.datasources[datasourceKey]
+	if !ok || !reflect.DeepEqual(entry.limits, *limits) {
+		entry = &datasourceLimiters{
+			limits:     copyRateLimits(limits),
+			datasource: newLimiter(limits.Datasource),
+			users:      map[string]*userLimiter{},
+		}
+		limiters.datasources[datasourceKey] = entry
+	}
+	if limits.User == nil {
+		return entry.datasource, nil
+	}
+
+	bucket, ok := entry.users[user]
+	if !ok {
+		if len(entry.users) >= maxUserLimiters {
+			entry.sweepUsers(now)
+		}
+		if len(entry.users) >= maxUserLimiters {
+			entry.evictLeastRecentlyUsed()
+		}
+		bucket = &userLimiter{limiter: newLimiter(limits.User)}
+		entry.users[user] = bucket
+	}
+	bucket.lastUsed = now
+	return entry.datasource, bucket.limiter
+}
+
+// sweepLocked drops the buckets of the datasources that are gone or no
+// longer rate limited, and the user buckets that can be forgotten.
+func (limiters *rateLimiters) sweepLocked(now time.Time) {
+	limiters.lastSweep = now
+	for datasourceKey, entry := range limiters.datasources {
+		datasource := limiters.lookup(datasourceKey)
+		if datasource == nil || datasource.Spec.Plugin.Spec.RateLimits == nil {
+			delete(limiters.datasources, datasourceKey)
+			continue
+		}
+		entry.sweepUsers(now)
+	}
+}
+
+// sweepUsers drops the user buckets that are full or idle.
+func (entry *datasourceLimiters) sweepUsers(now time.Time) {
+	for key, bucket := range entry.users {
+		if now.Sub(bucket.lastUsed) >= userLimiterIdleTimeout || bucket.limiter.TokensAt(now) >= float64(bucket.limiter.Burst()) {
+			delete(entry.users, key)
+		}
+	}
+}
+
+// evictLeastRecentlyUsed drops the user bucket used the longest ago.
+func (entry *datasourceLimiters) evictLeastRecentlyUsed() {
+	oldestKey := ""
+	var oldest *userLimiter
+	for key, bucket := range entry.users {
+		if oldest == nil || bucket.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, bucket
+		}
+	}
+	delete(entry.users, oldestKey)
+}
+
+// copyRateLimits copies the limits so that they are compared to the ones of
+// the datasource as they were when the buckets were built.
+func copyRateLimits(limits *datasources.RateLimits) datasources.RateLimits {
+	copied := datasources.RateLimits{}
+	if limits.Datasource != nil {
+		datasourceLimit := *limits.Datasource
+		copied.Datasource = &datasourceLimit
+	}
+	if limits.User != nil {
+		userLimit := *limits.User
+		copied.User = &userLimit
+	}
+	return copied
+}
+
+// userKey tells the users apart by a hash of their bearer token, so that
+// tokens are not kept in memory. The requests without a token share the
+// empty key.
+func userKey(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !isBearer(header) {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(header[len(prefix):])))
+	return hex.EncodeToString(hash[:])
+}
+
+// retryAfter formats the delay as the whole seconds of a Retry-After
+// header, at least one.
+func retryAfter(delay time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(delay.Seconds()))))
+}
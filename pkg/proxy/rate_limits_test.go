@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+func rateLimitedDatasource(directURL string, limits *datasources.RateLimits) *datasources.DataSource {
+	return &datasources.DataSource{
+		Metadata: datasources.DatasourceMetadata{Name: "prometheus", Namespace: "monitoring"},
+		Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+			Kind: datasources.PluginKindPrometheus,
+			Spec: datasources.DatasourcePluginSpec{DirectURL: directURL, RateLimits: limits},
+		}},
+	}
+}
+
+func userRequest(token string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return request
+}
+
+// prometheusKey is the datasource key of rateLimitedDatasource.
+const prometheusKey = "monitoring/prometheus"
+
+// lookupDatasource serves the datasource under prometheusKey.
+func lookupDatasource(datasource *datasources.DataSource) func(string) *datasources.DataSource {
+	return func(datasourceKey string) *datasources.DataSource {
+		if datasourceKey != prometheusKey {
+			return nil
+		}
+		return datasource
+	}
+}
+
+func TestRateLimiters_User(t *testing.T) {
+	datasource := rateLimitedDatasource("", &datasources.RateLimits{
+		User: &datasources.RateLimit{RequestsPerSecond: 0.5, Burst: 2},
+	})
+	limiters := newRateLimiters(lookupDatasource(datasource))
+
+	for i := 0; i < 2; i++ {
+		scope, delay := limiters.reserve(datasource, userRequest("alice"))
+		require.Empty(t, scope)
+		require.Zero(t, delay)
+	}
+	scope, delay := limiters.reserve(datasource, userRequest("alice"))
+	require.Equal(t, rateLimitScopeUser, scope)
+	require.InDelta(t, 2*time.Second, delay, float64(100*time.Millisecond))
+
+	// other users and the requests without token have buckets of their own
+	scope, _ = limiters.reserve(datasource, userRequest("bob"))
+	require.Empty(t, scope)
+	scope, _ = limiters.reserve(datasource, userRequest(""))
+	require.Empty(t, scope)
+
+	// changed limits start from full buckets
+	datasource.Spec.Plugin.Spec.RateLimits.User.Burst = 3
+	scope, _ = limiters.reserve(datasource, userRequest("alice"))
+	require.Empty(t, scope)
+}
+
+func TestRateLimiters_Datasource(t *testing.T) {
+	datasource := rateLimitedDatasource("", &datasources.RateLimits{
+		Datasource: &datasources.RateLimit{RequestsPerSecond: 1, Burst: 2},
+		User:       &datasources.RateLimit{RequestsPerSecond: 1, Burst: 1},
+	})
+	limiters := newRateLimiters(lookupDatasource(datasource))
+
+	scope, _ := limiters.reserve(datasource, userRequest("alice"))
+	require.Empty(t, scope)
+	scope, _ = limiters.reserve(datasource, userRequest("alice"))
+	require.Equal(t, rateLimitScopeUser, scope)
+	scope, _ = limiters.reserve(datasource, userRequest("bob"))
+	require.Empty(t, scope)
+	scope, _ = limiters.reserve(datasource, userRequest("carol"))
+	require.Equal(t, rateLimitScopeDatasource, scope)
+
+	// the user token is given back when the datasource bucket is empty
+	datasourceLimiter, userLimiter := limiters.get(prometheusKey, datasource.Spec.Plugin.Spec.RateLimits, userKey(userRequest("carol")), time.Now())
+	require.Less(t, datasourceLimiter.Tokens(), 1.0)
+	require.InDelta(t, 1.0, userLimiter.Tokens(), 0.01)
+}
+
+func TestRateLimiters_Sweep(t *testing.T) {
+	limits := &datasources.RateLimits{User: &datasources.RateLimit{RequestsPerSecond: 0.001, Burst: 2}}
+	datasource := rateLimitedDatasource("", limits)
+	limiters := newRateLimiters(lookupDatasource(datasource))
+	now := time.Now()
+
+	limiters.get(prometheusKey, limits, "alice", now)
+	limiters.get(prometheusKey, limits, "bob", now.Add(30*time.Second))
+	limiters.get("deleted", limits, "alice", now)
+	limiters.mutex.Lock()
+	limiters.datasources[prometheusKey].users["alice"].limiter.AllowN(now, 1)
+	limiters.datasources[prometheusKey].users["bob"].limiter.AllowN(now, 1)
+	limiters.mutex.Unlock()
+
+	// the next request past the sweep interval drops the buckets of the
+	// deleted datasource and the idle user buckets
+	limiters.get(prometheusKey, limits, "carol", now.Add(userLimiterIdleTimeout))
+	require.NotContains(t, limiters.datasources, "deleted")
+	require.NotContains(t, limiters.datasources[prometheusKey].users, "alice")
+	require.Contains(t, limiters.datasources[prometheusKey].users, "bob")
+
+	// the full buckets are dropped too, and so are the datasources no
+	// longer rate limited or deleted
+	limiters.get(prometheusKey, limits, "dave", now.Add(userLimiterIdleTimeout+limiterSweepInterval))
+	require.NotContains(t, limiters.datasources[prometheusKey].users, "bob")
+	require.NotContains(t, limiters.datasources[prometheusKey].users, "carol")
+
+	datasource.Spec.Plugin.Spec.RateLimits = nil
+	limiters.mutex.Lock()
+	limiters.sweepLocked(now.Add(2 * userLimiterIdleTimeout))
+	limiters.mutex.Unlock()
+	require.Empty(t, limiters.datasources)
+}
+
+func TestRateLimiters_MaxUsers(t *testing.T) {
+	limits := &datasources.RateLimits{User: &datasources.RateLimit{RequestsPerSecond: 0.001, Burst: 1}}
+	limiters := newRateLimiters(lookupDatasource(rateLimitedDatasource("", limits)))
+	now := time.Now()
+
+	for i := 0; i < maxUserLimiters; i++ {
+		_, limiter := limiters.get(prometheusKey, limits, strconv.Itoa(i), now.Add(time.Duration(i)*time.Millisecond))
+		require.True(t, limiter.AllowN(now, 1))
+	}
+	// user 0 is used again, making user 1 the least recently used
+	limiters.get(prometheusKey, limits, "0", now.Add(time.Second))
+
+	limiters.get(prometheusKey, limits, "new", now.Add(time.Second))
+	users := limiters.datasources[prometheusKey].users
+	require.Len(t, users, maxUserLimiters)
+	require.Contains(t, users, "0")
+	require.NotContains(t, users, "1")
+	require.Contains(t, users, "new")
+}
+
+func TestProxyHandler_RateLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	datasourceManager := datasources.NewDatasourceManager()
+	datasourceManager.SetDatasource("prometheus", rateLimitedDatasource(upstream.URL, &datasources.RateLimits{
+		Datasource: &datasources.RateLimit{RequestsPerSecond: 0.1},
+	}))
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
+	limited := rateLimitedRequests.WithLabelValues("prometheus", "monitoring", rateLimitScopeDatasource)
+	before := testutil.ToFloat64(limited)
+
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query", nil), map[string]string{"datasourceName": "prometheus"})
+		handler(recorder, request)
+		return recorder
+	}
+
+	require.Equal(t, http.StatusOK, serve().Code)
+	recorder := serve()
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Contains(t, []string{"9", "10"}, recorder.Header().Get("Retry-After"))
+	require.Equal(t, before+1, testutil.ToFloat64(limited))
+}
+
+func TestProxyHandler_RateLimitsSharedByRoutes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	datasource := rateLimitedDatasource(upstream.URL, &datasources.RateLimits{
+		Datasource: &datasources.RateLimit{RequestsPerSecond: 0.1, Burst: 1},
+	})
+	datasourceManager := datasources.NewDatasourceManager()
+	datasourceManager.SetDatasource("prometheus", datasource)
+	datasourceManager.SetDatasource(prometheusKey, datasource)
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query", nil), map[string]string{"datasourceName": "prometheus"}))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	// the namespaced route takes from the same bucket
+	recorder = httptest.NewRecorder()
+	handler(recorder, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/namespaces/monitoring/proxy/prometheus/api/v1/query", nil), map[string]string{"namespace": "monitoring", "datasourceName": "prometheus"}))
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+}
+
+func TestProxyHandler_RejectedRequestsKeepTokens(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	datasource := rateLimitedDatasource(upstream.URL, &datasources.RateLimits{
+		Datasource: &datasources.RateLimit{RequestsPerSecond: 0.1, Burst: 1},
+		User:       &datasources.RateLimit{RequestsPerSecond: 0.1, Burst: 1},
+	})
+	datasource.Spec.Plugin.Spec.NamespaceLabel = &datasources.NamespaceLabelEnforcement{}
+	datasourceManager := datasources.NewDatasourceManager()
+	datasourceManager.SetDatasource("prometheus", datasource)
+	handler := CreateProxyHandler(datasourceManager, 0, nil, Options{})
+
+	serve := func(query string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query?query="+url.QueryEscape(query), nil)
+		request.Header.Set("Authorization", "Bearer alice")
+		handler(recorder, mux.SetURLVars(request, map[string]string{"datasourceName": "prometheus"}))
+		return recorder.Code
+	}
+
+	require.Equal(t, http.StatusForbidden, serve(`up{namespace="team-b"}`))
+	require.Equal(t, http.StatusBadRequest, serve(`up{`))
+	require.Equal(t, http.StatusOK, serve(`up`))
+	require.Equal(t, http.StatusTooManyRequests, serve(`up`))
+}
+
+func TestRetryAfter(t *testing.T) {
+	require.Equal(t, "1", retryAfter(10*time.Millisecond))
+	require.Equal(t, "2", retryAfter(1500*time.Millisecond))
+	require.Equal(t, "10", retryAfter(10*time.Second))
+}
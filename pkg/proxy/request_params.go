@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxFormSize bounds the form encoded bodies read to rewrite their
+// parameters, the same bound as the one of http.Request.ParseForm.
+const maxFormSize = 10 << 20
+
+// requestError rejects a request the proxy cannot forward, with the status
+// code telling why.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (err *requestError) Error() string {
+	return err.message
+}
+
+func newRequestError(status int, format string, args ...interface{}) error {
+	return &requestError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// writeRequestError answers the request with the error, as a bad request
+// unless it is a requestError.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		http.Error(w, reqErr.message, reqErr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// rewriteParams rewrites the parameters of the request the way Prometheus
+// reads them: from its URL and, for POST requests, from its form encoded
+// body. Bodies Prometheus would parse otherwise, e.g. multipart forms, are
+// rejected so that no parameter escapes the rewrite.
+func rewriteParams(r *http.Request, rewrite func(url.Values) error) error {
+	params := r.URL.Query()
+	if err := rewrite(params); err != nil {
+		return err
+	}
+	r.URL.RawQuery = params.Encode()
+
+	form, ok, err := postForm(r)
+	if err != nil || !ok {
+		return err
+	}
+	if err := rewrite(form); err != nil {
+		return err
+	}
+	setPostForm(r, form)
+	return nil
+}
+
+// postForm reads the form encoded body of a POST request, false when the
+// request has none. The body is restored so that it can be read again.
+func postForm(r *http.Request) (url.Values, bool, error) {
+	if r.Method != http.MethodPost {
+		return nil, false, nil
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil, false, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false, newRequestError(http.StatusBadRequest, "invalid content type %q: %v", contentType, err)
+	}
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil, false, newRequestError(http.StatusUnsupportedMediaType, "unsupported content type %q, parameters must be form encoded", mediaType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxFormSize+1))
+	if err != nil {
+		return nil, false, newRequestError(http.StatusBadRequest, "cannot read the request body: %v", err)
+	}
+	if len(body) > maxFormSize {
+		return nil, false, newRequestError(http.StatusRequestEntityTooLarge, "request body larger than %d bytes", maxFormSize)
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, false, newRequestError(http.StatusBadRequest, "cannot parse the request body: %v", err)
+	}
+	setPostForm(r, form)
+	return form, true, nil
+}
+
+// setPostForm replaces the body of the request with the encoded form.
+func setPostForm(r *http.Request, form url.Values) {
+	encoded := form.Encode()
+	r.Body = io.NopCloser(strings.NewReader(encoded))
+	r.ContentLength = int64(len(encoded))
+	r.GetBody = nil
+}
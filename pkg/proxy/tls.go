@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	datasources "github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+// clientCertificates reads the client certificate the datasource presents
+// for mutual TLS, nil when it has none. The proxy is rebuilt when the
+// referenced Secret or ConfigMap changes, which reloads the certificate.
+func clientCertificates(datasourceManager *datasources.DatasourceManager, datasource *datasources.DataSource) ([]tls.Certificate, error) {
+	tlsSpec := datasource.Spec.Plugin.Spec.TLS
+	if tlsSpec == nil || tlsSpec.Cert == nil || tlsSpec.KeySecret == nil {
+		return nil, nil
+	}
+	namespace := datasource.Metadata.Namespace
+
+	certPEM, err := datasourceManager.GetSecretOrConfigMapKey(namespace, *tlsSpec.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the client certificate: %w", err)
+	}
+	keyPEM, err := datasourceManager.GetSecretKey(namespace, *tlsSpec.KeySecret)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the client key: %w", err)
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	return []tls.Certificate{certificate}, nil
+}
+
+// referencedCA reads the CA the datasource references, nil when it has none.
+// The proxy is rebuilt when the referenced Secret or ConfigMap changes, e.g.
+// when the service CA is rotated.
+func referencedCA(datasourceManager *datasources.DatasourceManager, datasource *datasources.DataSource) ([]byte, error) {
+	tlsSpec := datasource.Spec.Plugin.Spec.TLS
+	if tlsSpec == nil || tlsSpec.CA == nil {
+		return nil, nil
+	}
+
+	ca, err := datasourceManager.GetSecretOrConfigMapKey(datasource.Metadata.Namespace, *tlsSpec.CA)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the CA: %w", err)
+	}
+	return ca, nil
+}
+
+// rootCAs returns the CAs verifying the certificate of a datasource, nil for
+// the system CAs. The CA of the datasource replaces the system CAs unless
+// includeSystemCAs is set, the trusted bundle is added in any case.
+func rootCAs(ca []byte, includeSystemCAs bool, trustedBundle []byte) (*x509.CertPool, error) {
+	if len(ca) == 0 && len(trustedBundle) == 0 {
+		return nil, nil
+	}
+
+	var pool *x509.CertPool
+	if len(ca) == 0 || includeSystemCAs {
+		systemPool, err := x509.SystemCertPool()
+		if err != nil {
+			log.WithError(err).Warn("cannot load the system CAs")
+			systemPool = x509.NewCertPool()
+		}
+		pool = systemPool
+	} else {
+		pool = x509.NewCertPool()
+	}
+
+	if len(ca) > 0 && !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no valid PEM certificate found in the CA")
+	}
+	if len(trustedBundle) > 0 && !pool.AppendCertsFromPEM(trustedBundle) {
+		log.Warn("no valid PEM certificate found in the trusted CA bundle")
+	}
+	return pool, nil
+}
+
+// applyTLSOptions applies the TLS settings of the datasource. The minimum
+// version of the datasource can only raise the one of the backend.
+func applyTLSOptions(config *tls.Config, tlsSpec *datasources.DatasourceTLS, options Options, datasourceName string) error {
+	if tlsSpec == nil {
+		return nil
+	}
+
+	if tlsSpec.ServerName != "" {
+		config.ServerName = tlsSpec.ServerName
+		log.Debugf("Proxy using server name '%s' for datasource '%s'", tlsSpec.ServerName, datasourceName)
+	}
+
+	if tlsSpec.MinVersion != "" {
+		minVersion, err := datasources.ParseTLSVersion(tlsSpec.MinVersion)
+		if err != nil {
+			return err
+		}
+		if minVersion > config.MinVersion {
+			config.MinVersion = minVersion
+			log.Debugf("Proxy using TLS MinVersion: 0x%04x for datasource '%s'", minVersion, datasourceName)
+		} else if minVersion < config.MinVersion {
+			log.Warnf("TLS MinVersion %s of datasource '%s' is below the one of the backend, using 0x%04x", tlsSpec.MinVersion, datasourceName, config.MinVersion)
+		}
+	}
+
+	if tlsSpec.InsecureSkipVerify {
+		// such datasources fail to load, this only guards the transport
+		if options.DisallowInsecureSkipVerify {
+			return fmt.Errorf("insecureSkipVerify is disallowed on this cluster")
+		}
+		config.InsecureSkipVerify = true
+		log.Warnf("TLS certificate verification is DISABLED for datasource '%s', its connections can be intercepted", datasourceName)
+	}
+	return nil
+}
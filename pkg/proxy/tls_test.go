@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	certutil "k8s.io/client-go/util/cert"
+
+	datasources "github.com/openshift/console-dashboards-plugin/pkg/datasources"
+)
+
+func parseCertificate(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return certificate
+}
+
+func TestRootCAs(t *testing.T) {
+	datasourceCA, _, err := certutil.GenerateSelfSignedCertKey("datasource-ca", nil, nil)
+	require.NoError(t, err)
+	bundleCA, _, err := certutil.GenerateSelfSignedCertKey("bundle-ca", nil, nil)
+	require.NoError(t, err)
+
+	verifies := func(pool *x509.CertPool, certPEM []byte) bool {
+		_, err := parseCertificate(t, certPEM).Verify(x509.VerifyOptions{Roots: pool})
+		return err == nil
+	}
+
+	pool, err := rootCAs(nil, false, nil)
+	require.NoError(t, err)
+	require.Nil(t, pool, "the system CAs are used by default")
+
+	pool, err = rootCAs(datasourceCA, false, nil)
+	require.NoError(t, err)
+	require.True(t, verifies(pool, datasourceCA))
+	require.False(t, verifies(pool, bundleCA))
+
+	pool, err = rootCAs(datasourceCA, false, bundleCA)
+	require.NoError(t, err)
+	require.True(t, verifies(pool, datasourceCA))
+	require.True(t, verifies(pool, bundleCA))
+
+	pool, err = rootCAs(nil, false, bundleCA)
+	require.NoError(t, err)
+	require.True(t, verifies(pool, bundleCA))
+
+	systemPool, err := x509.SystemCertPool()
+	require.NoError(t, err)
+	pool, err = rootCAs(datasourceCA, true, nil)
+	require.NoError(t, err)
+	require.True(t, verifies(pool, datasourceCA))
+	systemPool.AppendCertsFromPEM(datasourceCA)
+	require.True(t, pool.Equal(systemPool), "the datasource CA is added to the system CAs")
+
+	_, err = rootCAs([]byte("not a certificate"), false, nil)
+	require.Error(t, err)
+}
+
+func TestProxyHandler_TrustedCABundle(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	bundleFile := filepath.Join(t.TempDir(), "ca-bundle.crt")
+	require.NoError(t, os.WriteFile(bundleFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+
+	datasourceManager := datasources.NewDatasourceManager()
+	datasourceManager.SetDatasource("prometheus", &datasources.DataSource{
+		Spec: datasources.DatasourceSpec{Plugin: datasources.DatasourcePlugin{
+			Kind: datasources.PluginKindPrometheus,
+			Spec: datasources.DatasourcePluginSpec{DirectURL: upstream.URL},
+		}},
+	})
+
+	query := func(options Options) int {
+		handler := CreateProxyHandler(datasourceManager, 0, nil, options)
+		recorder := httptest.NewRecorder()
+		request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/proxy/prometheus/api/v1/query", nil), map[string]string{"datasourceName": "prometheus"})
+		handler(recorder, request)
+		datasourceManager.ResetProxies()
+		return recorder.Code
+	}
+
+	require.Equal(t, http.StatusBadGateway, query(Options{}))
+	require.Equal(t, http.StatusOK, query(Options{TrustedCABundleFile: bundleFile}))
+}
+
+func TestResetOnCABundleChange(t *testing.T) {
+	bundleCA, _, err := certutil.GenerateSelfSignedCertKey("bundle-ca", nil, nil)
+	require.NoError(t, err)
+	bundleFile := filepath.Join(t.TempDir(), "ca-bundle.crt")
+	require.NoError(t, os.WriteFile(bundleFile, bundleCA, 0600))
+
+	now := time.Now()
+	config := &proxyConfig{caBundle: newWatchedFile(bundleFile)}
+	config.caBundle.now = func() time.Time { return now }
+
+	datasourceManager := datasources.NewDatasourceManager()
+	datasourceManager.SetDatasource("prometheus", &datasources.DataSource{})
+	datasourceManager.SetProxy("prometheus", &httputil.ReverseProxy{})
+
+	config.resetOnCABundleChange(datasourceManager)
+	require.NotNil(t, datasourceManager.GetProxy("prometheus"))
+
+	rotatedCA, _, err := certutil.GenerateSelfSignedCertKey("rotated-ca", nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(bundleFile, rotatedCA, 0600))
+	require.NoError(t, os.Chtimes(bundleFile, now.Add(time.Minute), now.Add(time.Minute)))
+	now = now.Add(fileCheckInterval)
+
+	config.resetOnCABundleChange(datasourceManager)
+	require.Nil(t, datasourceManager.GetProxy("prometheus"))
+	require.Equal(t, rotatedCA, config.trustedCABundle())
+}
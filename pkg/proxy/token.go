@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultServiceAccountTokenFile is where the token of the pod service
+// account is mounted.
+const DefaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// tokenFile reads a token from a file and re-reads it when the file changes,
+// such as the projected service account token kubelet rotates.
+type tokenFile struct {
+	*watchedFile
+}
+
+func newTokenFile(path string) *tokenFile {
+	if path == "" {
+		path = DefaultServiceAccountTokenFile
+	}
+	return &tokenFile{watchedFile: newWatchedFile(path)}
+}
+
+// Token returns the current token.
+func (f *tokenFile) Token() (string, error) {
+	data, _, err := f.Read()
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", f.path)
+	}
+	return token, nil
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenFile_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0600))
+
+	now := time.Now()
+	tokens := newTokenFile(path)
+	tokens.now = func() time.Time { return now }
+
+	token, err := tokens.Token()
+	require.NoError(t, err)
+	require.Equal(t, "first", token)
+
+	// kubelet swaps the file, the new token is seen at the next check
+	rotated := filepath.Join(dir, "rotated")
+	require.NoError(t, os.WriteFile(rotated, []byte("second"), 0600))
+	require.NoError(t, os.Chtimes(rotated, now.Add(time.Minute), now.Add(time.Minute)))
+	require.NoError(t, os.Rename(rotated, path))
+
+	token, err = tokens.Token()
+	require.NoError(t, err)
+	require.Equal(t, "first", token)
+
+	now = now.Add(fileCheckInterval)
+	token, err = tokens.Token()
+	require.NoError(t, err)
+	require.Equal(t, "second", token)
+
+	// a missing file keeps the last token
+	require.NoError(t, os.Remove(path))
+	now = now.Add(fileCheckInterval)
+	token, err = tokens.Token()
+	require.NoError(t, err)
+	require.Equal(t, "second", token)
+}
+
+func TestTokenFile_Missing(t *testing.T) {
+	_, err := newTokenFile(filepath.Join(t.TempDir(), "token")).Token()
+	require.Error(t, err)
+}
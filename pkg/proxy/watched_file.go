@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileCheckInterval is how often watched files are checked for changes.
+// Kubelet updates mounted Secrets and ConfigMaps, and rotates projected
+// tokens well before they expire, so the previous content stays usable until
+// the new one is seen.
+const fileCheckInterval = 10 * time.Second
+
+// watchedFile caches the content of a file and re-reads it when it changes,
+// such as the files kubelet mounts and updates.
+type watchedFile struct {
+	path string
+	now  func() time.Time
+
+	mutex   sync.Mutex
+	data    []byte
+	read    bool
+	failed  bool
+	modTime time.Time
+	size    int64
+	checked time.Time
+	// generation is incremented every time the content changes
+	generation int
+}
+
+func newWatchedFile(path string) *watchedFile {
+	return &watchedFile{path: path, now: time.Now}
+}
+
+// Read returns the current content of the file and its generation. When the
+// file cannot be read anymore, the last content read is returned until the
+// file is back.
+func (f *watchedFile) Read() ([]byte, int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.now()
+	if f.read && now.Sub(f.checked) < fileCheckInterval {
+		return f.data, f.generation, nil
+	}
+	f.checked = now
+
+	info, err := os.Stat(f.path)
+	if err == nil && f.read && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.data, f.generation, nil
+	}
+
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(f.path)
+	}
+	if err != nil {
+		if f.read {
+			log.WithError(err).Warnf("cannot re-read file %s, using its previous content", f.path)
+			return f.data, f.generation, nil
+		}
+		f.failed = true
+		return nil, 0, err
+	}
+
+	// a file showing up after it could not be read is a change as well
+	if (f.read && string(data) != string(f.data)) || (!f.read && f.failed) {
+		log.Infof("file %s changed, using its new content", f.path)
+		f.generation++
+	}
+	f.data = data
+	f.read = true
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return f.data, f.generation, nil
+}
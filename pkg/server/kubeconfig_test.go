@@ -0,0 +1,67 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com:6443
+- name: staging
+  cluster:
+    server: https://staging.example.com:6443
+users:
+- name: developer
+  user:
+    token: test-token
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: developer
+- name: staging
+  context:
+    cluster: staging
+    user: developer
+current-context: dev
+`
+
+func writeKubeconfig(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(path, []byte(testKubeconfig), 0o600))
+	return path
+}
+
+func TestLoadRestConfig_CurrentContext(t *testing.T) {
+	config, err := loadRestConfig(writeKubeconfig(t), "")
+	require.NoError(t, err)
+	require.Equal(t, "https://dev.example.com:6443", config.Host)
+	require.Equal(t, "test-token", config.BearerToken)
+}
+
+func TestLoadRestConfig_SelectedContext(t *testing.T) {
+	config, err := loadRestConfig(writeKubeconfig(t), "staging")
+	require.NoError(t, err)
+	require.Equal(t, "https://staging.example.com:6443", config.Host)
+}
+
+func TestLoadRestConfig_KubeconfigEnv(t *testing.T) {
+	t.Setenv("KUBECONFIG", writeKubeconfig(t))
+
+	config, err := loadRestConfig("", "")
+	require.NoError(t, err)
+	require.Equal(t, "https://dev.example.com:6443", config.Host)
+}
+
+func TestLoadRestConfig_UnknownContext(t *testing.T) {
+	_, err := loadRestConfig(writeKubeconfig(t), "missing")
+	require.Error(t, err)
+}
@@ -10,10 +10,15 @@ import (
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	apiv1 "github.com/openshift/console-dashboards-plugin/pkg/api/v1"
+	authorization "github.com/openshift/console-dashboards-plugin/pkg/authorization"
 	datasources "github.com/openshift/console-dashboards-plugin/pkg/datasources"
 	proxy "github.com/openshift/console-dashboards-plugin/pkg/proxy"
 )
@@ -123,14 +128,51 @@ func extractValidatedTLSParams(cfg *Config) (serverMinVersion uint16, serverCiph
 }
 
 type Config struct {
-	Port                int
-	CertFile            string
-	PrivateKeyFile      string
-	StaticPath          string
-	LogLevel            string
-	DashboardsNamespace string
-	TLSMinVersion       uint16
-	TLSCipherSuites     []uint16
+	Port                        int
+	CertFile                    string
+	PrivateKeyFile              string
+	StaticPath                  string
+	LogLevel                    string
+	DashboardsNamespaces        []string
+	DashboardsNamespaceSelector string
+	DatasourceAuthorization     string
+	DatasourcesDir              string
+	TLSMinVersion               uint16
+	TLSCipherSuites             []uint16
+	// ServiceAccountTokenFile is the token sent to datasources using the
+	// service-account auth mode.
+	ServiceAccountTokenFile string
+	// DisallowInsecureSkipVerify refuses datasources that disable TLS
+	// certificate verification.
+	DisallowInsecureSkipVerify bool
+	// TrustedCABundleFile holds CAs trusted for every datasource.
+	TrustedCABundleFile string
+	// URLPolicy, when set, restricts the URLs datasources may target.
+	URLPolicy *datasources.URLPolicy
+	// ServiceAccountAuth allows the service-account auth mode to the
+	// datasources of the default namespace and of ServiceAccountNamespaces.
+	ServiceAccountAuth       bool
+	ServiceAccountNamespaces []string
+	// ForwardUserTokenNamespaces and ForwardUserTokenUpstreams allow the
+	// forward-user-token auth mode outside the default namespace, to the
+	// datasources of the listed namespaces and of the listed upstreams.
+	ForwardUserTokenNamespaces []string
+	ForwardUserTokenUpstreams  []string
+	// RequireNamespaceLabel and NamespaceLabelUpstreams require the
+	// datasources outside the default namespace and
+	// NamespaceLabelExemptNamespaces to restrict their queries to their
+	// namespace, respectively all of them or the ones targeting the listed
+	// shared upstreams.
+	RequireNamespaceLabel          bool
+	NamespaceLabelUpstreams        []string
+	NamespaceLabelExemptNamespaces []string
+	// Kubeconfig and KubeContext select the cluster when not running in a
+	// pod, or override the in-cluster configuration.
+	Kubeconfig  string
+	KubeContext string
+	// KubeClient, when set, is used to watch datasources instead of a
+	// client built from the kubeconfig.
+	KubeClient kubernetes.Interface
 }
 
 func (c *Config) IsTLSEnabled() bool {
@@ -192,9 +234,53 @@ func (s *PluginServer) Shutdown(ctx context.Context) error {
 }
 
 func createHTTPServer(ctx context.Context, cfg *Config) (*http.Server, error) {
+	authorizationMode, err := authorization.ParseMode(cfg.DatasourceAuthorization)
+	if err != nil {
+		return nil, err
+	}
+
+	restConfig, err := loadRestConfig(cfg.Kubeconfig, cfg.KubeContext)
+	if err != nil {
+		if authorizationMode != authorization.ModeNone {
+			return nil, fmt.Errorf("cannot load kubernetes client config for datasource authorization: %w", err)
+		}
+		log.WithError(err).Error("cannot load kubernetes client config")
+	}
+
+	var authorizer *authorization.Authorizer
+	if authorizationMode != authorization.ModeNone {
+		authorizer = authorization.NewAuthorizer(restConfig, authorizationMode)
+		log.Infof("datasource authorization enabled with mode: %s", authorizationMode)
+	}
+
 	datasourceManager := datasources.NewDatasourceManager()
+	policy := &datasources.Policy{
+		URLs:                           cfg.URLPolicy,
+		DisallowInsecureSkipVerify:     cfg.DisallowInsecureSkipVerify,
+		ServiceAccountAuth:             cfg.ServiceAccountAuth,
+		ServiceAccountNamespaces:       cfg.ServiceAccountNamespaces,
+		ForwardUserTokenNamespaces:     cfg.ForwardUserTokenNamespaces,
+		ForwardUserTokenUpstreams:      cfg.ForwardUserTokenUpstreams,
+		RequireNamespaceLabel:          cfg.RequireNamespaceLabel,
+		NamespaceLabelUpstreams:        cfg.NamespaceLabelUpstreams,
+		NamespaceLabelExemptNamespaces: cfg.NamespaceLabelExemptNamespaces,
+	}
 
-	go datasourceManager.WatchDatasources(cfg.DashboardsNamespace)
+	kubeClient, dynamicClient, err := kubernetesClients(cfg, restConfig)
+	if err != nil {
+		log.WithError(err).Error("cannot create k8s client")
+	}
+	if kubeClient != nil {
+		go datasourceManager.WatchDatasources(ctx, kubeClient, dynamicClient, datasources.WatchOptions{
+			Namespaces:        cfg.DashboardsNamespaces,
+			NamespaceSelector: cfg.DashboardsNamespaceSelector,
+			Policy:            policy,
+		})
+	}
+
+	if cfg.DatasourcesDir != "" {
+		go datasourceManager.Run(ctx, datasources.NewFileProvider(cfg.DatasourcesDir, policy))
+	}
 
 	serverMinVersion, serverCipherSuites, proxyMinVersion, proxyCipherSuites, err := extractValidatedTLSParams(cfg)
 	if err != nil {
@@ -221,8 +307,19 @@ func createHTTPServer(ctx context.Context, cfg *Config) (*http.Server, error) {
 	muxRouter := mux.NewRouter()
 
 	muxRouter.PathPrefix("/health").HandlerFunc(healthHandler())
-	muxRouter.PathPrefix("/proxy/{datasourceName}/").HandlerFunc(proxy.CreateProxyHandler(datasourceManager, proxyMinVersion, proxyCipherSuites))
-	muxRouter.HandleFunc("/api/v1/datasources/{name}", apiv1.CreateDashboardsHandler(datasourceManager))
+	muxRouter.Handle("/metrics", promhttp.Handler())
+	proxyHandler := authorizer.Handler(datasourceManager, "datasourceName", proxy.CreateProxyHandler(datasourceManager, proxyMinVersion, proxyCipherSuites, proxy.Options{
+		ServiceAccountTokenFile:    cfg.ServiceAccountTokenFile,
+		DisallowInsecureSkipVerify: cfg.DisallowInsecureSkipVerify,
+		TrustedCABundleFile:        cfg.TrustedCABundleFile,
+		URLPolicy:                  cfg.URLPolicy,
+		Policy:                     policy,
+	}))
+	muxRouter.PathPrefix("/proxy/{datasourceName}/").HandlerFunc(proxyHandler)
+	muxRouter.PathPrefix("/namespaces/{namespace}/proxy/{datasourceName}/").HandlerFunc(proxyHandler)
+	dashboardsHandler := authorizer.Handler(datasourceManager, "name", apiv1.CreateDashboardsHandler(datasourceManager))
+	muxRouter.HandleFunc("/api/v1/datasources/{name}", dashboardsHandler)
+	muxRouter.HandleFunc("/api/v1/namespaces/{namespace}/datasources/{name}", dashboardsHandler)
 	muxRouter.PathPrefix("/").Handler(filesHandler(http.Dir(cfg.StaticPath)))
 
 	if tlsEnabled {
@@ -314,6 +411,27 @@ func healthHandler() http.HandlerFunc {
 	})
 }
 
+// kubernetesClients returns the clients watching datasources, nil when there
+// is no cluster to watch.
+func kubernetesClients(cfg *Config, restConfig *rest.Config) (kubernetes.Interface, dynamic.Interface, error) {
+	if cfg.KubeClient != nil {
+		return cfg.KubeClient, nil, nil
+	}
+	if restConfig == nil {
+		return nil, nil, nil
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, dynamicClient, nil
+}
+
 func Start(cfg *Config) error {
 	ctx := context.Background()
 	server, err := CreateServer(ctx, cfg)
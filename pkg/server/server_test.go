@@ -22,6 +22,9 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 
 	"github.com/openshift/console-dashboards-plugin/pkg/datasources"
 	"github.com/openshift/console-dashboards-plugin/pkg/proxy"
@@ -58,10 +61,10 @@ func TestServerRunning(t *testing.T) {
 
 	go func() {
 		Start(&Config{
-			Port:                testPort,
-			LogLevel:            "error",
-			StaticPath:          "./web/dist",
-			DashboardsNamespace: "test-namespace",
+			Port:                 testPort,
+			LogLevel:             "error",
+			StaticPath:           "./web/dist",
+			DashboardsNamespaces: []string{"test-namespace"},
 		})
 	}()
 
@@ -130,12 +133,12 @@ func TestSecureServerRunning(t *testing.T) {
 
 	rnd.Seed(time.Now().UnixNano())
 	conf := &Config{
-		CertFile:            testServerCertFile,
-		PrivateKeyFile:      testServerKeyFile,
-		Port:                testPort,
-		LogLevel:            "error",
-		StaticPath:          "./web/dist",
-		DashboardsNamespace: "test-namespace",
+		CertFile:             testServerCertFile,
+		PrivateKeyFile:       testServerKeyFile,
+		Port:                 testPort,
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
 	}
 
 	serverURL := fmt.Sprintf("https://%s", testServerHostPort)
@@ -374,13 +377,13 @@ func TestTLSMinVersionConfiguration(t *testing.T) {
 
 	// Test with TLS 1.3 minimum version
 	conf := &Config{
-		CertFile:            testServerCertFile,
-		PrivateKeyFile:      testServerKeyFile,
-		Port:                testPort,
-		TLSMinVersion:       tls.VersionTLS13,
-		LogLevel:            "error",
-		StaticPath:          "./web/dist",
-		DashboardsNamespace: "test-namespace",
+		CertFile:             testServerCertFile,
+		PrivateKeyFile:       testServerKeyFile,
+		Port:                 testPort,
+		TLSMinVersion:        tls.VersionTLS13,
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
 	}
 
 	serverURL := fmt.Sprintf("https://%s", testServerHostPort)
@@ -439,14 +442,14 @@ func TestTLSCipherSuitesConfiguration(t *testing.T) {
 
 	// Test with specific cipher suites
 	conf := &Config{
-		CertFile:            testServerCertFile,
-		PrivateKeyFile:      testServerKeyFile,
-		Port:                testPort,
-		TLSMinVersion:       tls.VersionTLS12,
-		TLSCipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
-		LogLevel:            "error",
-		StaticPath:          "./web/dist",
-		DashboardsNamespace: "test-namespace",
+		CertFile:             testServerCertFile,
+		PrivateKeyFile:       testServerKeyFile,
+		Port:                 testPort,
+		TLSMinVersion:        tls.VersionTLS12,
+		TLSCipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
 	}
 
 	serverURL := fmt.Sprintf("https://%s", testServerHostPort)
@@ -490,14 +493,14 @@ func TestServerCreationWithTLSConfiguration(t *testing.T) {
 	require.NoError(t, err)
 
 	conf := &Config{
-		CertFile:            testServerCertFile,
-		PrivateKeyFile:      testServerKeyFile,
-		Port:                testPort,
-		TLSMinVersion:       tls.VersionTLS13,
-		TLSCipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
-		LogLevel:            "error",
-		StaticPath:          "./web/dist",
-		DashboardsNamespace: "test-namespace",
+		CertFile:             testServerCertFile,
+		PrivateKeyFile:       testServerKeyFile,
+		Port:                 testPort,
+		TLSMinVersion:        tls.VersionTLS13,
+		TLSCipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
 	}
 
 	tmpDirAssets := prepareServerAssets(t)
@@ -528,12 +531,12 @@ func TestTLSBackwardCompatibility(t *testing.T) {
 
 	// Test with no TLS configuration (should default to TLS 1.2 minimum)
 	conf := &Config{
-		CertFile:            testServerCertFile,
-		PrivateKeyFile:      testServerKeyFile,
-		Port:                testPort,
-		LogLevel:            "error",
-		StaticPath:          "./web/dist",
-		DashboardsNamespace: "test-namespace",
+		CertFile:             testServerCertFile,
+		PrivateKeyFile:       testServerKeyFile,
+		Port:                 testPort,
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
 		// TLSMinVersion and TLSCipherSuites not set (zero values)
 	}
 
@@ -613,10 +616,10 @@ func TestProxySystemCAIntegration(t *testing.T) {
 	require.NoError(t, err)
 
 	conf := &Config{
-		Port:                testPort,
-		LogLevel:            "error",
-		StaticPath:          "./web/dist",
-		DashboardsNamespace: "test-namespace",
+		Port:                 testPort,
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
 	}
 
 	ctx := context.Background()
@@ -642,14 +645,14 @@ func TestServerProxyTLSIndependence(t *testing.T) {
 	require.NoError(t, err)
 
 	conf := &Config{
-		CertFile:            testServerCertFile,
-		PrivateKeyFile:      testServerKeyFile,
-		Port:                testPort,
-		TLSMinVersion:       tls.VersionTLS12,
-		TLSCipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
-		LogLevel:            "error",
-		StaticPath:          "./web/dist",
-		DashboardsNamespace: "test-namespace",
+		CertFile:             testServerCertFile,
+		PrivateKeyFile:       testServerKeyFile,
+		Port:                 testPort,
+		TLSMinVersion:        tls.VersionTLS12,
+		TLSCipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
 	}
 
 	tmpDirAssets := prepareServerAssets(t)
@@ -666,11 +669,11 @@ func TestServerProxyTLSIndependence(t *testing.T) {
 
 	datasourceManager := datasources.NewDatasourceManager()
 
-	proxyHandler13 := proxy.CreateProxyHandler(datasourceManager, uint16(tls.VersionTLS13), nil)
+	proxyHandler13 := proxy.CreateProxyHandler(datasourceManager, uint16(tls.VersionTLS13), nil, proxy.Options{})
 	require.NotNil(t, proxyHandler13)
 
 	differentCipherSuite := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
-	proxyHandlerDifferent := proxy.CreateProxyHandler(datasourceManager, uint16(tls.VersionTLS12), differentCipherSuite)
+	proxyHandlerDifferent := proxy.CreateProxyHandler(datasourceManager, uint16(tls.VersionTLS12), differentCipherSuite, proxy.Options{})
 	require.NotNil(t, proxyHandlerDifferent)
 
 	require.NotSame(t, proxyHandler13, proxyHandlerDifferent, "Proxy handlers should be independent instances")
@@ -957,3 +960,39 @@ func TestCipherSuitesToStrings(t *testing.T) {
 		})
 	}
 }
+
+func TestServerWatchesInjectedClient(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-datasource",
+			Namespace: "test-namespace",
+			Labels:    map[string]string{"console.openshift.io/dashboard-datasource": "true"},
+		},
+		Data: map[string]string{"dashboard-datasource.yaml": `kind: "Datasource"
+metadata:
+  name: "test-datasource"
+spec:
+  plugin:
+    kind: "prometheus"
+    spec:
+      direct_url: "https://prometheus:9091"
+`},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := CreateServer(ctx, &Config{
+		LogLevel:             "error",
+		StaticPath:           "./web/dist",
+		DashboardsNamespaces: []string{"test-namespace"},
+		Kubeconfig:           filepath.Join(t.TempDir(), "missing"),
+		KubeClient:           client,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		recorder := httptest.NewRecorder()
+		server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/datasources/test-datasource", nil))
+		return recorder.Code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+}
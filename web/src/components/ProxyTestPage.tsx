@@ -2,7 +2,7 @@ import * as React from 'react';
 import getDataSource from '../getDatasource';
 
 const DEFAULT_PROXY_URL =
-  '/api/proxy/plugin/console-dashboards-plugin/backend/proxy/cluster-prometheus-proxy/api/v1/status/config';
+  '/api/proxy/plugin/console-dashboards-plugin/backend/proxy/cluster-prometheus-proxy/api/v1/query?query=up';
 const DEFAULT_DATASOURCE_NAME = 'cluster-prometheus-proxy';
 
 const getCSRFToken = () => {